@@ -0,0 +1,66 @@
+/*
+Copyright © 2019 Even Holthe
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"github.com/evenh/az-blob-hashdeep/internal"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var (
+	leftStrip         string
+	rightStrip        string
+	compareOutputFile string
+	showIdentical     bool
+	tempDir           string
+	sortChunkSize     int
+)
+
+var compareCmd = &cobra.Command{
+	Use:   "compare <left> <right>",
+	Short: "Compare two hashdeep file lists offline",
+	Long: `Compare two hashdeep file lists, e.g. one produced by hashdeep on the
+source side and one produced by the generate command.
+
+Every difference is written as a tab separated line prefixed with one of
+content-changed, size-changed, moved, only-in-left or only-in-right. The
+files are sorted on disk, so they do not have to fit in memory. Exits with
+a non-zero code upon any difference.`,
+	Args: cobra.ExactArgs(2),
+	Run:  runCompare,
+}
+
+func init() {
+	rootCmd.AddCommand(compareCmd)
+
+	compareCmd.Flags().StringVar(&leftStrip, "left-strip", "", "Prefix to remove from the paths in the left file, e.g. /mnt/share/ for a hashdeep -r manifest with absolute paths")
+	compareCmd.Flags().StringVar(&rightStrip, "right-strip", "", "Prefix to remove from the paths in the right file")
+	compareCmd.Flags().StringVarP(&compareOutputFile, "output", "o", "", "File path to write the differences to (default: stdout)")
+	compareCmd.Flags().BoolVar(&showIdentical, "show-identical", false, "Also list identical files")
+	compareCmd.Flags().StringVar(&tempDir, "temp-dir", "", "Directory for temporary sort files (default: system temp directory)")
+	compareCmd.Flags().IntVar(&sortChunkSize, "sort-chunk-size", 500000, "Number of entries to sort in memory before spilling to disk")
+}
+
+func runCompare(cmd *cobra.Command, args []string) {
+	c, err := internal.NewCompareConfig(args[0], args[1], leftStrip, rightStrip, compareOutputFile, showIdentical, tempDir, sortChunkSize)
+
+	if err != nil {
+		log.Fatalf("Configuration error: %+v", err)
+	}
+
+	internal.Compare(cancelOnInterrupt(), c)
+}
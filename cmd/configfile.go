@@ -0,0 +1,194 @@
+/*
+Copyright © 2019 Even Holthe
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/evenh/az-blob-hashdeep/internal"
+	"github.com/spf13/pflag"
+)
+
+// Builds the configuration of every container to generate output for. Flags
+// given on the command line take precedence over the config file, which in
+// turn takes precedence over environment variables and flag defaults.
+func generateConfigs(flags *pflag.FlagSet, mode string) ([]*internal.GenerateConfig, error) {
+	if configFile == "" {
+		var sources []internal.TraversalConfig
+		for _, spec := range sourceSpecs {
+			source, err := internal.ParseSource(traversalConfig(), spec)
+			if err != nil {
+				return nil, err
+			}
+			sources = append(sources, source)
+		}
+
+		c, err := internal.NewGenerateConfig(traversalConfig(), sources, outputFile, resume, writeState, incremental, knownFiles, mode, verbosity)
+		if err != nil {
+			return nil, err
+		}
+
+		return []*internal.GenerateConfig{c}, nil
+	}
+
+	if len(sourceSpecs) > 0 {
+		return nil, errors.New("--source cannot be combined with --config, list the sources in the config file instead")
+	}
+	if directory != "" {
+		return nil, errors.New("--local cannot be combined with --config")
+	}
+
+	file, err := internal.LoadConfigFile(configFile)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(file.Sources) > 0 {
+		traversal := traversalConfig()
+		output := outputFile
+		applyFileSettings(flags, &file.FileSettings, &traversal, &output)
+
+		var sources []internal.TraversalConfig
+		for _, settings := range file.SourceSettings() {
+			source := traversalConfig()
+			var ignored string
+			applyFileSettings(flags, &settings, &source, &ignored)
+			// Only the output as a whole gets the prefix given by flag
+			source.Prefix = settings.Prefix
+			sources = append(sources, source)
+		}
+
+		c, err := internal.NewGenerateConfig(traversal, sources, output, resume, writeState, incremental, knownFiles, mode, verbosity)
+		if err != nil {
+			return nil, err
+		}
+
+		return []*internal.GenerateConfig{c}, nil
+	}
+
+	var configs []*internal.GenerateConfig
+	outputs := make(map[string]string)
+
+	for _, job := range file.Jobs() {
+		traversal := traversalConfig()
+		output := outputFile
+		applyFileSettings(flags, &job, &traversal, &output)
+
+		c, err := internal.NewGenerateConfig(traversal, nil, output, resume, writeState, incremental, knownFiles, mode, verbosity)
+		if err != nil {
+			return nil, fmt.Errorf("container '%s': %w", job.Container, err)
+		}
+
+		if other, exists := outputs[c.OutputFile]; exists {
+			return nil, fmt.Errorf("containers '%s' and '%s' both write to %s, use {account} and {container} in the output path", other, c.Container, c.OutputFile)
+		}
+		outputs[c.OutputFile] = c.Container
+
+		configs = append(configs, c)
+	}
+
+	return configs, nil
+}
+
+// Copies the settings from the config file that were not overridden by a flag
+func applyFileSettings(flags *pflag.FlagSet, s *internal.FileSettings, c *internal.TraversalConfig, output *string) {
+	setString := func(flag string, target *string, value string) {
+		if value != "" && !flags.Changed(flag) {
+			*target = value
+		}
+	}
+	setBool := func(flag string, target *bool, value *bool) {
+		if value != nil && !flags.Changed(flag) {
+			*target = *value
+		}
+	}
+
+	setString("account-name", &c.AccountName, s.AccountName)
+	setString("container", &c.Container, s.Container)
+	setString("auth", &c.Auth, s.Auth)
+	// Any account key, SAS token or connection string flag replaces the credential of the config file, whatever its kind
+	credentialFlags := []string{"account-key", "account-key-file", "sas-token", "sas-token-file", "connection-string"}
+	if !anyChanged(flags, credentialFlags...) {
+		c.AccountKeyFile = s.AccountKeyFile
+		c.SasTokenFile = s.SasTokenFile
+	}
+	setString("tenant-id", &c.TenantID, s.TenantID)
+	setString("client-id", &c.ClientID, s.ClientID)
+	setString("client-certificate", &c.ClientCertificate, s.ClientCertificate)
+	setString("federated-token-file", &c.FederatedTokenFile, s.FederatedTokenFile)
+	setString("cloud", &c.Cloud, s.Cloud)
+	setString("endpoint", &c.Endpoint, s.Endpoint)
+	setString("prefix", &c.Prefix, s.Prefix)
+	setString("cache", &c.CacheFile, s.Cache)
+	setString("archive", &c.Archive, s.Archive)
+	setString("rehydrate-tier", &c.RehydrateTier, s.RehydrateTier)
+	setString("rehydrate-priority", &c.RehydratePriority, s.RehydratePriority)
+	setString("exclude-from", &c.ExcludeFrom, s.ExcludeFrom)
+	setString("min-size", &c.MinSize, s.MinSize)
+	setString("max-size", &c.MaxSize, s.MaxSize)
+	setString("modified-after", &c.ModifiedAfter, s.ModifiedAfter)
+	setString("modified-before", &c.ModifiedBefore, s.ModifiedBefore)
+	setString("output", output, s.Output)
+	setBool("all-containers", &c.AllContainers, s.AllContainers)
+	setBool("path-style", &c.PathStyle, s.PathStyle)
+	setBool("strip-prefix", &c.StripPrefix, s.StripPrefix)
+	setBool("include-versions", &c.IncludeVersions, s.IncludeVersions)
+	setBool("include-snapshots", &c.IncludeSnapshots, s.IncludeSnapshots)
+	setBool("include-deleted", &c.IncludeDeleted, s.IncludeDeleted)
+	setBool("calculate", &c.Calculate, s.Calculate)
+
+	if len(s.IncludeContainers) > 0 && !flags.Changed("include-container") {
+		c.IncludeContainers = s.IncludeContainers
+	}
+	if len(s.ExcludeContainers) > 0 && !flags.Changed("exclude-container") {
+		c.ExcludeContainers = s.ExcludeContainers
+	}
+	if len(s.IncludePrefixes) > 0 && !flags.Changed("include-prefix") {
+		c.IncludePrefixes = s.IncludePrefixes
+	}
+	if len(s.Include) > 0 && !flags.Changed("include") {
+		c.Include = s.Include
+	}
+	if len(s.Exclude) > 0 && !flags.Changed("exclude") {
+		c.Exclude = s.Exclude
+	}
+	if len(s.ContentTypes) > 0 && !flags.Changed("content-type") {
+		c.ContentTypes = s.ContentTypes
+	}
+	if len(s.Tiers) > 0 && !flags.Changed("tier") {
+		c.Tiers = s.Tiers
+	}
+	if len(s.Algorithms) > 0 && !flags.Changed("algorithms") {
+		c.Algorithms = s.Algorithms
+	}
+	if s.RehydrateWait > 0 && !flags.Changed("rehydrate-wait") {
+		c.RehydrateWait = s.RehydrateWait
+	}
+	if s.Workers > 0 && !flags.Changed("workers") {
+		c.WorkerCount = s.Workers
+	}
+}
+
+func anyChanged(flags *pflag.FlagSet, names ...string) bool {
+	for _, name := range names {
+		if flags.Changed(name) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,67 @@
+/*
+Copyright © 2019 Even Holthe
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"testing"
+
+	"github.com/evenh/az-blob-hashdeep/internal"
+	"github.com/spf13/pflag"
+)
+
+func TestApplyFileSettingsCredentials(t *testing.T) {
+	settings := internal.FileSettings{AccountName: "file", AccountKeyFile: "/secrets/key"}
+
+	tests := []struct {
+		name        string
+		args        []string
+		wantAccount string
+		wantKeyFile string
+	}{
+		{name: "config file", wantAccount: "file", wantKeyFile: "/secrets/key"},
+		{name: "account key flag", args: []string{"--account-key", "key"}, wantAccount: "file"},
+		{name: "sas token file flag", args: []string{"--sas-token-file", "-"}, wantAccount: "file"},
+		{name: "connection string flag", args: []string{"--connection-string", "AccountName=file;AccountKey=key"}, wantAccount: "file"},
+		{name: "account name flag", args: []string{"--account-name", "flag"}, wantAccount: "flag", wantKeyFile: "/secrets/key"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var c internal.TraversalConfig
+			var output string
+
+			flags := pflag.NewFlagSet(test.name, pflag.ContinueOnError)
+			flags.StringVar(&c.AccountName, "account-name", "", "")
+			flags.StringVar(&c.AccountKey, "account-key", "", "")
+			flags.StringVar(&c.AccountKeyFile, "account-key-file", "", "")
+			flags.StringVar(&c.SasToken, "sas-token", "", "")
+			flags.StringVar(&c.SasTokenFile, "sas-token-file", "", "")
+			flags.StringVar(&c.ConnectionString, "connection-string", "", "")
+			if err := flags.Parse(test.args); err != nil {
+				t.Fatal(err)
+			}
+
+			applyFileSettings(flags, &settings, &c, &output)
+
+			if c.AccountName != test.wantAccount {
+				t.Errorf("AccountName = %q, want %q", c.AccountName, test.wantAccount)
+			}
+			if c.AccountKeyFile != test.wantKeyFile {
+				t.Errorf("AccountKeyFile = %q, want %q", c.AccountKeyFile, test.wantKeyFile)
+			}
+		})
+	}
+}
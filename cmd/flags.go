@@ -0,0 +1,203 @@
+/*
+Copyright © 2019 Even Holthe
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"time"
+
+	"github.com/evenh/az-blob-hashdeep/internal"
+	"github.com/evenh/az-blob-hashdeep/internal/hashes"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// Shared by every command that traverses a container
+var (
+	accountName       string
+	connectionString  string
+	auth              string
+	accountKey        string
+	accountKeyFile    string
+	sasToken          string
+	sasTokenFile      string
+	container         string
+	allContainers     bool
+	includeContainers []string
+	excludeContainers []string
+	directory         string
+	ignoreSkipped     bool
+
+	tenantID                  string
+	clientID                  string
+	clientSecret              string
+	clientCertificate         string
+	clientCertificatePassword string
+	federatedTokenFile        string
+
+	cloud             string
+	endpoint          string
+	pathStyle         bool
+	prefix            string
+	includePrefixes   []string
+	stripPrefix       bool
+	include           []string
+	exclude           []string
+	excludeFrom       string
+	minSize           string
+	maxSize           string
+	modifiedAfter     string
+	modifiedBefore    string
+	contentTypes      []string
+	tiers             []string
+	includeVersions   bool
+	includeSnapshots  bool
+	includeDeleted    bool
+	calculate         bool
+	archive           string
+	rehydrateTier     string
+	rehydratePriority string
+	rehydrateWait     time.Duration
+	cacheFile         string
+	algorithms        []string
+)
+
+func addTraversalFlags(cmd *cobra.Command) {
+	cmd.Flags().StringVarP(&accountName, "account-name", "n", "", "Azure Blob Storage Account Name (env: AZURE_STORAGE_ACCOUNT)")
+	cmd.Flags().StringVarP(&accountKey, "account-key", "k", "", "Azure Blob Storage Account Key (env: AZURE_STORAGE_KEY)")
+	cmd.Flags().StringVar(&accountKeyFile, "account-key-file", "", "File to read the Account Key from, - for stdin")
+	cmd.Flags().StringVarP(&sasToken, "sas-token", "s", "", "Azure Blob Storage SAS Token (env: AZURE_STORAGE_SAS_TOKEN)")
+	cmd.Flags().StringVar(&sasTokenFile, "sas-token-file", "", "File to read the SAS Token from, - for stdin")
+	cmd.Flags().StringVar(&connectionString, "connection-string", "", "Azure Storage connection string (env: AZURE_STORAGE_CONNECTION_STRING)")
+	cmd.Flags().StringVar(&auth, "auth", "", "Authentication method: shared-key, sas, client-secret, client-certificate, workload-identity, managed-identity or azure-cli (default: inferred from --account-key/--sas-token)")
+	cmd.Flags().StringVar(&tenantID, "tenant-id", "", "Entra ID tenant ID (env: AZURE_TENANT_ID)")
+	cmd.Flags().StringVar(&clientID, "client-id", "", "Entra ID application or managed identity client ID (env: AZURE_CLIENT_ID)")
+	cmd.Flags().StringVar(&clientSecret, "client-secret", "", "Entra ID client secret (env: AZURE_CLIENT_SECRET)")
+	cmd.Flags().StringVar(&clientCertificate, "client-certificate", "", "Path to a PEM or PKCS#12 client certificate including the private key (env: AZURE_CLIENT_CERTIFICATE_PATH)")
+	cmd.Flags().StringVar(&clientCertificatePassword, "client-certificate-password", "", "Password of the client certificate (env: AZURE_CLIENT_CERTIFICATE_PASSWORD)")
+	cmd.Flags().StringVar(&federatedTokenFile, "federated-token-file", "", "Federated token file for workload identity (env: AZURE_FEDERATED_TOKEN_FILE)")
+	cmd.Flags().StringVarP(&container, "container", "c", "", "Azure Blob Storage container")
+	cmd.Flags().BoolVar(&allContainers, "all-containers", false, "Traverse every container in the account, writing one output per container when the output path contains {container}, otherwise a combined output")
+	cmd.Flags().StringArrayVar(&includeContainers, "include-container", nil, "With --all-containers, only traverse containers matching this glob, or regular expression when prefixed with regex:, may be repeated")
+	cmd.Flags().StringArrayVar(&excludeContainers, "exclude-container", nil, "With --all-containers, skip containers matching this glob, or regular expression when prefixed with regex:, may be repeated")
+	cmd.Flags().StringVar(&cloud, "cloud", "", "Azure cloud: public, china or usgov (default public)")
+	cmd.Flags().StringVar(&endpoint, "endpoint", "", "Custom blob service endpoint, e.g. https://myaccount.privatelink.blob.core.windows.net or http://127.0.0.1:10000 for Azurite")
+	cmd.Flags().BoolVar(&pathStyle, "path-style", false, "Append the account name to the --endpoint path (implied for IP addresses and localhost)")
+	cmd.Flags().StringVarP(&prefix, "prefix", "p", "", "Optional prefix to prepend to file paths")
+	cmd.Flags().StringArrayVar(&includePrefixes, "include-prefix", nil, "Only list blobs whose name starts with this prefix, may be repeated")
+	cmd.Flags().BoolVar(&stripPrefix, "strip-prefix", false, "Remove the include prefix from file paths, requires a single --include-prefix")
+	cmd.Flags().StringArrayVar(&include, "include", nil, "Only hash blobs matching this glob, or regular expression when prefixed with regex:, may be repeated")
+	cmd.Flags().StringArrayVar(&exclude, "exclude", nil, "Skip blobs matching this glob, or regular expression when prefixed with regex:, may be repeated")
+	cmd.Flags().StringVar(&excludeFrom, "exclude-from", "", "File with exclude patterns, one per line")
+	cmd.Flags().StringVar(&minSize, "min-size", "", "Skip blobs smaller than this size, e.g. 1024, 10MB or 1GiB (KB, MB, GB, TB are powers of 1000; K, M, G, T and KiB, MiB, GiB, TiB powers of 1024)")
+	cmd.Flags().StringVar(&maxSize, "max-size", "", "Skip blobs larger than this size, see --min-size for the units")
+	cmd.Flags().StringVar(&modifiedAfter, "modified-after", "", "Only hash blobs last modified after this time (YYYY-MM-DD or RFC 3339)")
+	cmd.Flags().StringVar(&modifiedBefore, "modified-before", "", "Only hash blobs last modified before this time (YYYY-MM-DD or RFC 3339)")
+	cmd.Flags().StringSliceVar(&contentTypes, "content-type", nil, "Comma separated content types to hash, e.g. application/pdf,image/*")
+	cmd.Flags().StringSliceVar(&tiers, "tier", nil, "Comma separated access tiers to hash: hot, cool, archive")
+	cmd.Flags().BoolVar(&includeVersions, "include-versions", false, "Also hash previous versions of blobs, listed as <name>?versionid=<id>")
+	cmd.Flags().BoolVar(&includeSnapshots, "include-snapshots", false, "Also hash blob snapshots, listed as <name>?snapshot=<timestamp>")
+	cmd.Flags().BoolVar(&includeDeleted, "include-deleted", false, "Also list soft-deleted blobs, written to <output>.deleted (only the MD5 from metadata is available for them)")
+	cmd.Flags().BoolVar(&calculate, "calculate", false, "Calculate hashes locally instead of pulling the MD5 from metadata")
+	cmd.Flags().StringVar(&archive, "archive", hashes.ArchiveSkip, "Handling of Archive tier blobs when calculating: skip, metadata (use the MD5 from metadata if only md5 is requested) or rehydrate")
+	cmd.Flags().StringVar(&rehydrateTier, "rehydrate-tier", "hot", "Tier to rehydrate Archive blobs to: hot or cool")
+	cmd.Flags().StringVar(&rehydratePriority, "rehydrate-priority", "standard", "Rehydration priority: standard or high")
+	cmd.Flags().DurationVar(&rehydrateWait, "rehydrate-wait", 0, "Wait up to this long (e.g. 15h) for rehydration and hash the blobs in a second pass")
+	cmd.Flags().StringVar(&cacheFile, "cache", "", "Database of calculated hashes to reuse for blobs with an unchanged ETag, shared between runs")
+	cmd.Flags().StringSliceVar(&algorithms, "algorithms", []string{"md5"}, "Comma separated digest algorithms: md5, sha1, sha256, sha512, whirlpool (anything but md5 requires --calculate)")
+}
+
+func traversalConfig() internal.TraversalConfig {
+	return internal.TraversalConfig{
+		AccountName:        accountName,
+		Container:          container,
+		AllContainers:      allContainers,
+		IncludeContainers:  includeContainers,
+		ExcludeContainers:  excludeContainers,
+		Directory:          directory,
+		IgnoreSkippedFiles: ignoreSkipped,
+		ConnectionString:   connectionString,
+
+		Auth:           auth,
+		AccountKey:     accountKey,
+		AccountKeyFile: accountKeyFile,
+		SasToken:       sasToken,
+		SasTokenFile:   sasTokenFile,
+
+		TenantID:                  tenantID,
+		ClientID:                  clientID,
+		ClientSecret:              clientSecret,
+		ClientCertificate:         clientCertificate,
+		ClientCertificatePassword: clientCertificatePassword,
+		FederatedTokenFile:        federatedTokenFile,
+
+		Cloud:             cloud,
+		Endpoint:          endpoint,
+		PathStyle:         pathStyle,
+		Prefix:            prefix,
+		IncludePrefixes:   includePrefixes,
+		StripPrefix:       stripPrefix,
+		Include:           include,
+		Exclude:           exclude,
+		ExcludeFrom:       excludeFrom,
+		MinSize:           minSize,
+		MaxSize:           maxSize,
+		ModifiedAfter:     modifiedAfter,
+		ModifiedBefore:    modifiedBefore,
+		ContentTypes:      contentTypes,
+		Tiers:             tiers,
+		IncludeVersions:   includeVersions,
+		IncludeSnapshots:  includeSnapshots,
+		IncludeDeleted:    includeDeleted,
+		Calculate:         calculate,
+		Archive:           archive,
+		RehydrateTier:     rehydrateTier,
+		RehydratePriority: rehydratePriority,
+		RehydrateWait:     rehydrateWait,
+		CacheFile:         cacheFile,
+		WorkerCount:       workerCount,
+		Algorithms:        algorithms,
+	}
+}
+
+// Returns a context that is cancelled upon Ctrl+C
+func cancelOnInterrupt() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	ch := make(chan os.Signal, 1)
+	var count int32 = 0
+	signal.Notify(ch, os.Interrupt)
+	go func() {
+		for sig := range ch {
+			switch {
+			case count > 1:
+				log.Fatal("cancellation requested multiple times, killing process hard")
+			case count > 0:
+				log.Warnf("cancellation already requested, awaiting shutdown – will kill process upon next SIGINT/Ctrl+C")
+			default:
+				log.Infof("Received signal: %v, cancelling background tasks…", sig)
+				cancel()
+			}
+
+			atomic.AddInt32(&count, 1)
+		}
+	}()
+
+	return ctx
+}
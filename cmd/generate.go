@@ -16,10 +16,8 @@ limitations under the License.
 package cmd
 
 import (
-	"context"
+	"errors"
 	"os"
-	"os/signal"
-	"sync/atomic"
 
 	"github.com/evenh/az-blob-hashdeep/internal"
 	log "github.com/sirupsen/logrus"
@@ -27,61 +25,99 @@ import (
 )
 
 var (
-	accountName string
-	accountKey  string
-	sasToken    string
-	container   string
-	outputFile  string
-	prefix      string
-	calculate   bool
+	configFile    string
+	sourceSpecs   []string
+	outputFile    string
+	resume        bool
+	writeState    bool
+	incremental   string
+	knownFiles    []string
+	audit         bool
+	match         bool
+	negativeMatch bool
+	verbosity     int
 )
 
 var generateCmd = &cobra.Command{
 	Use:   "generate",
 	Short: "Generate a hashdeep compatible file list from an Azure Blob Storage container",
-	Run:   run,
+	Long: `Generate a hashdeep compatible file list from an Azure Blob Storage container.
+
+With --local, the files below a local directory are hashed instead, with the
+same path handling as blobs: paths relative to the directory with forward
+slashes, the same prefix options and Unicode NFC normalization. The output can
+then be compared with that of a container.`,
+	Run: run,
 }
 
 func init() {
 	rootCmd.AddCommand(generateCmd)
 
-	generateCmd.Flags().StringVarP(&accountName, "account-name", "n", "", "Azure Blob Storage Account Name")
-	generateCmd.Flags().StringVarP(&accountKey, "account-key", "k", "", "Azure Blob Storage Account Key")
-	generateCmd.Flags().StringVarP(&sasToken, "sas-token", "s", "", "Azure Blob Storage SAS Token")
-	generateCmd.Flags().StringVarP(&container, "container", "c", "", "Azure Blob Storage container")
-	generateCmd.Flags().StringVarP(&outputFile, "output", "o", "", "File path to write results to (e.g. ~/az-hashdeep.txt)")
-	generateCmd.Flags().StringVarP(&prefix, "prefix", "p", "", "Optional prefix to prepend to file paths")
-	generateCmd.Flags().BoolVar(&calculate, "calculate", false, "Generate MD5 hashes locally instead of pulling from metadata")
+	addTraversalFlags(generateCmd)
+	generateCmd.Flags().StringVar(&configFile, "config", "", "YAML file describing the containers to process, overridden by flags")
+	generateCmd.Flags().StringVar(&directory, "local", "", "Local directory to hash instead of a container")
+	generateCmd.Flags().BoolVar(&ignoreSkipped, "ignore-skipped-files", false, "With --local, succeed even if unreadable files and directories, symbolic links and other special files were skipped")
+	generateCmd.Flags().StringArrayVar(&sourceSpecs, "source", nil, "Container to combine into the output as account/container[/prefix][=path], replacing the prefix with path in output paths, may be repeated. Sources share the credentials of the other flags, use a config file for per-source credentials")
+	generateCmd.Flags().StringVarP(&outputFile, "output", "o", "", "File path to write results to (e.g. ~/az-hashdeep.txt), may contain {account}, {container} and {date}")
+	generateCmd.Flags().BoolVar(&resume, "resume", false, "Continue an interrupted run, appending to its output file")
+	generateCmd.Flags().BoolVar(&writeState, "state", false, "Write a state file next to the output file for later incremental runs")
+	generateCmd.Flags().StringVar(&incremental, "incremental", "", "Previous output file whose state file is used to skip hashing unchanged blobs, implies --state")
+	generateCmd.Flags().StringArrayVar(&knownFiles, "known", nil, "Hashdeep file with known hashes for audit or matching mode, may be repeated")
+	generateCmd.Flags().BoolVarP(&audit, "audit", "a", false, "Audit the container against the known hashes and write an audit report")
+	generateCmd.Flags().BoolVarP(&match, "match", "m", false, "Write the paths of blobs matching the known hashes")
+	generateCmd.Flags().BoolVarP(&negativeMatch, "negative-match", "x", false, "Write the paths of blobs not matching the known hashes")
+	generateCmd.Flags().CountVarP(&verbosity, "verbose", "v", "Audit report verbosity, -v for counts and -vv for every file")
 }
 
 func run(cmd *cobra.Command, args []string) {
-	c, err := internal.NewGenerateConfig(accountName, accountKey, sasToken, container, outputFile, prefix, calculate, workerCount)
+	mode, err := generateMode()
+	if err != nil {
+		log.Fatalf("Configuration error: %+v", err)
+	}
+
+	configs, err := generateConfigs(cmd.Flags(), mode)
 
 	if err != nil {
 		log.Fatalf("Configuration error: %+v", err)
 	}
 
-	ctx, cancel := context.WithCancel(context.Background())
-
-	// Handle Ctrl+C
-	ch := make(chan os.Signal, 1)
-	var count int32 = 0
-	signal.Notify(ch, os.Interrupt)
-	go func() {
-		for sig := range ch {
-			switch {
-			case count > 1:
-				log.Fatal("cancellation requested multiple times, killing process hard")
-			case count > 0:
-				log.Warnf("cancellation already requested, awaiting shutdown – will kill process upon next SIGINT/Ctrl+C")
-			default:
-				log.Infof("Received signal: %v, cancelling background tasks…", sig)
-				cancel()
-			}
-
-			atomic.AddInt32(&count, 1)
+	ctx := cancelOnInterrupt()
+	failed := false
+	for _, c := range configs {
+		if !internal.Generate(ctx, c) {
+			failed = true
 		}
-	}()
+		if ctx.Err() != nil {
+			log.Warn("skipping remaining containers because of cancellation")
+			break
+		}
+	}
+
+	if failed {
+		log.Error("failed, exiting!")
+		os.Exit(1)
+	}
+
+	log.Info("all done, exiting!")
+}
+
+func generateMode() (string, error) {
+	modes := map[string]bool{
+		internal.ModeAudit:         audit,
+		internal.ModeMatch:         match,
+		internal.ModeNegativeMatch: negativeMatch,
+	}
+
+	mode := internal.ModeNone
+	for m, enabled := range modes {
+		if !enabled {
+			continue
+		}
+		if mode != internal.ModeNone {
+			return "", errors.New("only one of --audit, --match and --negative-match may be specified")
+		}
+		mode = m
+	}
 
-	internal.Generate(ctx, c)
+	return mode, nil
 }
@@ -0,0 +1,52 @@
+/*
+Copyright © 2019 Even Holthe
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"github.com/evenh/az-blob-hashdeep/internal"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var inputFile string
+
+var verifyCmd = &cobra.Command{
+	Use:   "verify",
+	Short: "Verify an existing hashdeep file list against an Azure Blob Storage container",
+	Long: `Verify an existing hashdeep file list against an Azure Blob Storage container.
+
+Every blob is compared by size and digests with its entry in the file list. Blobs
+that match, mismatch, are missing from the container or are not present in
+the file list are reported. Exits with a non-zero code upon any difference.`,
+	Run: runVerify,
+}
+
+func init() {
+	rootCmd.AddCommand(verifyCmd)
+
+	addTraversalFlags(verifyCmd)
+	verifyCmd.Flags().StringVarP(&inputFile, "input", "i", "", "Hashdeep file to verify the container against")
+}
+
+func runVerify(cmd *cobra.Command, args []string) {
+	c, err := internal.NewVerifyConfig(traversalConfig(), inputFile)
+
+	if err != nil {
+		log.Fatalf("Configuration error: %+v", err)
+	}
+
+	internal.Verify(cancelOnInterrupt(), c)
+}
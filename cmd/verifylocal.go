@@ -0,0 +1,54 @@
+/*
+Copyright © 2019 Even Holthe
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"github.com/evenh/az-blob-hashdeep/internal"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var verifyLocalCmd = &cobra.Command{
+	Use:   "verify-local <directory>",
+	Short: "Verify a local directory against an Azure Blob Storage container",
+	Long: `Verify a local directory against an Azure Blob Storage container without
+writing a hashdeep file list for either.
+
+The container and the directory are listed concurrently and merged in name
+order. Paths present on one side only and differing sizes are reported as soon
+as they are listed, files of the same size are hashed on both sides and their
+digests compared. The directory corresponds to the container, or to the
+include prefix with --strip-prefix. Exits with a non-zero code upon any
+difference.`,
+	Args: cobra.ExactArgs(1),
+	Run:  runVerifyLocal,
+}
+
+func init() {
+	rootCmd.AddCommand(verifyLocalCmd)
+
+	addTraversalFlags(verifyLocalCmd)
+}
+
+func runVerifyLocal(cmd *cobra.Command, args []string) {
+	c, err := internal.NewVerifyLocalConfig(traversalConfig(), args[0])
+
+	if err != nil {
+		log.Fatalf("Configuration error: %+v", err)
+	}
+
+	internal.VerifyLocal(cancelOnInterrupt(), c)
+}
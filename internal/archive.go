@@ -0,0 +1,157 @@
+/*
+Copyright © 2019 Even Holthe
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package internal
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob"
+	"github.com/evenh/az-blob-hashdeep/internal/hashes"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// How often blobs being rehydrated are checked during the second pass
+const rehydrationPollInterval = 5 * time.Minute
+
+// Blobs being rehydrated, hashed in a second pass once they are online
+type rehydrationQueue struct {
+	mu    sync.Mutex
+	items []azblob.BlobItemInternal
+}
+
+// Adds a blob to the queue, reporting false when there is no second pass
+func (q *rehydrationQueue) add(item azblob.BlobItemInternal) bool {
+	if q == nil {
+		return false
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.items = append(q.items, item)
+
+	return true
+}
+
+// Waits until the queued blobs are online and hashes them. Blobs still
+// offline when the wait is over are reported as rehydrating.
+func awaitRehydration(ctx context.Context, s *source, workerCount int, files chan *HashdeepEntry) {
+	logger := log.WithField("phase", "rehydration")
+	items := s.pending.items
+	deadline := time.Now().Add(s.config.RehydrateWait)
+
+	// Blobs still offline in the second pass are not queued again
+	retry := *s
+	retry.pending = nil
+
+	for len(items) > 0 {
+		wait := time.Until(deadline)
+		if wait <= 0 {
+			break
+		}
+		if wait > rehydrationPollInterval {
+			wait = rehydrationPollInterval
+		}
+
+		logger.Infof("waiting for %d blobs to be rehydrated", len(items))
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+
+		var online, offline []azblob.BlobItemInternal
+		for _, item := range items {
+			ready, err := s.downloader.Refresh(ctx, &item)
+			if err != nil {
+				handleErrors("refresh_tier", errors.Wrapf(err, "could not check tier of %s", s.path(item)))(logger)
+			}
+			if ready {
+				online = append(online, item)
+			} else {
+				offline = append(offline, item)
+			}
+		}
+		items = offline
+
+		if len(online) == 0 {
+			continue
+		}
+
+		logger.Infof("hashing %d rehydrated blobs", len(online))
+		hashJobs, workersGroup := configureBackgroundWorkers(ctx, workerCount, files)
+		for _, item := range online {
+			select {
+			case hashJobs <- hashJob{item: item, source: &retry}:
+			case <-ctx.Done():
+			}
+		}
+		close(hashJobs)
+		workersGroup.Wait()
+	}
+
+	for _, item := range items {
+		logger.WithField("status", hashes.StatusRehydrating).Warnf("%s is still being rehydrated", s.path(item))
+		entry := s.newEntry(item)
+		entry.status = hashes.StatusRehydrating
+		select {
+		case files <- entry:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Validates the handling of Archive tier blobs
+func validateArchive(c *TraversalConfig) error {
+	switch c.Archive {
+	case "":
+		c.Archive = hashes.ArchiveSkip
+	case hashes.ArchiveSkip, hashes.ArchiveMetadata:
+	case hashes.ArchiveRehydrate:
+		tier, ok := canonical(c.RehydrateTier, string(azblob.AccessTierHot), string(azblob.AccessTierCool))
+		if !ok {
+			return errors.Errorf("unknown rehydration tier '%s', expected hot or cool", c.RehydrateTier)
+		}
+		priority, ok := canonical(c.RehydratePriority, string(azblob.RehydratePriorityStandard), string(azblob.RehydratePriorityHigh))
+		if !ok {
+			return errors.Errorf("unknown rehydration priority '%s', expected standard or high", c.RehydratePriority)
+		}
+		c.RehydrateTier, c.RehydratePriority = tier, priority
+	default:
+		return errors.Errorf("unknown archive handling '%s', expected skip, metadata or rehydrate", c.Archive)
+	}
+
+	if c.RehydrateWait > 0 && c.Archive != hashes.ArchiveRehydrate {
+		return errors.New("waiting for rehydration requires rehydrate archive handling")
+	}
+
+	return nil
+}
+
+// Returns the option matching value regardless of case, e.g. Hot for hot
+func canonical(value string, options ...string) (string, bool) {
+	for _, option := range options {
+		if strings.EqualFold(value, option) {
+			return option, true
+		}
+	}
+
+	return "", false
+}
@@ -0,0 +1,298 @@
+/*
+Copyright © 2019 Even Holthe
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package internal
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/evenh/az-blob-hashdeep/internal/hashdeep"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// Modes mirroring hashdeep's -a, -m and -x flags
+const (
+	ModeNone          = ""
+	ModeAudit         = "audit"
+	ModeMatch         = "match"
+	ModeNegativeMatch = "negative-match"
+)
+
+const programName = "az-blob-hashdeep"
+
+type matchStatus int
+
+const (
+	statusNoMatch matchStatus = iota
+	statusPartialMatch
+	statusFileMoved
+	statusExactMatch
+)
+
+type knownFile struct {
+	entry *hashdeep.Entry
+	used  bool
+}
+
+// Known hashes loaded from one or more hashdeep files, indexed by digest
+type knownHashes struct {
+	files  []*knownFile
+	byHash map[string][]*knownFile
+}
+
+func loadKnownHashes(paths []string, algorithms []string) (*knownHashes, error) {
+	known := &knownHashes{byHash: make(map[string][]*knownFile)}
+
+	for _, path := range paths {
+		if err := known.load(path, algorithms); err != nil {
+			return nil, err
+		}
+	}
+
+	return known, nil
+}
+
+func (k *knownHashes) load(path string, algorithms []string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader := hashdeep.NewReader(file)
+	declared, err := reader.Algorithms()
+	if err != nil {
+		return errors.Wrapf(err, "could not parse known hashes '%s'", path)
+	}
+
+	common := false
+	for _, algorithm := range declared {
+		common = common || contains(algorithms, algorithm)
+	}
+	if !common {
+		return errors.Errorf("known hashes '%s' contain none of the computed algorithms (%s)", path, strings.Join(algorithms, ","))
+	}
+
+	count := 0
+	for {
+		entry, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return errors.Wrapf(err, "could not parse known hashes '%s'", path)
+		}
+
+		f := &knownFile{entry: entry}
+		k.files = append(k.files, f)
+		for algorithm, value := range entry.Hashes {
+			key := algorithm + ":" + value
+			k.byHash[key] = append(k.byHash[key], f)
+		}
+		count++
+	}
+
+	log.WithField("phase", "load_known_hashes").Infof("loaded %d known hashes from %s", count, path)
+	return nil
+}
+
+// Finds the best match for a file among the known hashes, the same way hashdeep does
+func (k *knownHashes) match(path string, size int64, hashes map[string]string) (matchStatus, *knownFile) {
+	var (
+		best       *knownFile
+		bestStatus = statusNoMatch
+	)
+
+	for algorithm, value := range hashes {
+		for _, candidate := range k.byHash[algorithm+":"+value] {
+			status := statusPartialMatch
+			if candidate.entry.Size == size && sameHashes(candidate.entry, &hashdeep.Entry{Hashes: hashes}) {
+				status = statusFileMoved
+				if candidate.entry.Path == path {
+					status = statusExactMatch
+				}
+			}
+
+			if status > bestStatus {
+				best, bestStatus = candidate, status
+			}
+		}
+	}
+
+	return bestStatus, best
+}
+
+// AuditOutputFile writes the output of the audit and matching modes instead of a file list
+type AuditOutputFile struct {
+	OutputFile string
+	PathPrefix string
+	Mode       string
+	Verbosity  int
+	Known      *knownHashes
+	file       *os.File
+	writer     *bufio.Writer
+
+	matched, partial, moved, unknown, unused, skipped uint64
+}
+
+func (a *AuditOutputFile) Open() error {
+	file, err := createOutputFile(a.OutputFile)
+	if err != nil {
+		return err
+	}
+
+	a.file = file
+	a.writer = bufio.NewWriterSize(file, 1024*5)
+
+	return nil
+}
+
+func (a *AuditOutputFile) WriteEntry(e *HashdeepEntry) error {
+	path := a.PathPrefix + e.path
+
+	if e.status != "" {
+		a.skipped++
+		if a.Mode == ModeAudit && a.Verbosity >= 2 {
+			if _, err := a.writer.WriteString(path + ": Not hashed, " + e.status + "\n"); err != nil {
+				return errors.Wrapf(err, "error while writing entry to output file '%s'", a.OutputFile)
+			}
+		}
+
+		return nil
+	}
+
+	status, known := a.Known.match(path, e.size, e.hashes)
+	if known != nil {
+		known.used = true
+	}
+
+	var err error
+	switch a.Mode {
+	case ModeMatch:
+		if status != statusNoMatch {
+			_, err = a.writer.WriteString(path + "\n")
+		}
+	case ModeNegativeMatch:
+		if status == statusNoMatch {
+			_, err = a.writer.WriteString(path + "\n")
+		}
+	case ModeAudit:
+		err = a.audit(path, status, known)
+	}
+
+	if err != nil {
+		return errors.Wrapf(err, "error while writing entry to output file '%s'", a.OutputFile)
+	}
+
+	return nil
+}
+
+func (a *AuditOutputFile) audit(path string, status matchStatus, known *knownFile) error {
+	var detail string
+	switch status {
+	case statusExactMatch:
+		a.matched++
+		detail = "Ok"
+	case statusFileMoved:
+		a.moved++
+		detail = "Moved from " + known.entry.Path
+	case statusPartialMatch:
+		a.partial++
+		detail = "Partial match with " + known.entry.Path
+	default:
+		a.unknown++
+		detail = "No match"
+	}
+
+	if a.Verbosity < 2 || status == statusExactMatch {
+		return nil
+	}
+
+	_, err := a.writer.WriteString(path + ": " + detail + "\n")
+	return err
+}
+
+// Failed reports whether an audit found any difference
+func (a *AuditOutputFile) Failed() bool {
+	return a.Mode == ModeAudit && (a.partial > 0 || a.moved > 0 || a.unknown > 0 || a.unused > 0 || a.skipped > 0)
+}
+
+func (a *AuditOutputFile) Close() error {
+	if a.Mode == ModeAudit {
+		if err := a.writeSummary(); err != nil {
+			return errors.Wrapf(err, "could not write audit summary to '%s'", a.OutputFile)
+		}
+	}
+
+	if err := a.writer.Flush(); err != nil {
+		return errors.Wrap(err, "could not flush output writer")
+	}
+
+	if err := a.file.Close(); err != nil {
+		return errors.Wrapf(err, "could not close results file '%s'", a.OutputFile)
+	}
+
+	log.Info("flushed and closed results file")
+	return nil
+}
+
+func (a *AuditOutputFile) writeSummary() error {
+	for _, f := range a.Known.files {
+		if f.used {
+			continue
+		}
+
+		a.unused++
+		if a.Verbosity >= 2 {
+			if _, err := a.writer.WriteString(f.entry.Path + ": Known file not used\n"); err != nil {
+				return err
+			}
+		}
+	}
+
+	result := "passed"
+	if a.Failed() {
+		result = "failed"
+	}
+	lines := []string{fmt.Sprintf("%s: Audit %s", programName, result)}
+
+	if a.Verbosity >= 1 {
+		lines = append(lines,
+			fmt.Sprintf("          Files matched: %d", a.matched),
+			fmt.Sprintf("Files partially matched: %d", a.partial),
+			fmt.Sprintf("            Files moved: %d", a.moved),
+			fmt.Sprintf("        New files found: %d", a.unknown),
+			fmt.Sprintf("  Known files not found: %d", a.unused),
+		)
+		// Not part of the hashdeep summary, only shown for archived blobs
+		if a.skipped > 0 {
+			lines = append(lines, fmt.Sprintf("       Files not hashed: %d", a.skipped))
+		}
+	}
+
+	for _, line := range lines {
+		log.Info(line)
+		if _, err := a.writer.WriteString(line + "\n"); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,204 @@
+/*
+Copyright © 2019 Even Holthe
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/evenh/az-blob-hashdeep/internal/hashdeep"
+)
+
+func TestAuditOutputFile(t *testing.T) {
+	const known = "%%%% HASHDEEP-1.0\n%%%% size,md5,filename\n" +
+		"1,aa,same.txt\n2,bb,old.txt\n3,cc,partial.txt\n4,dd,gone.txt\n"
+
+	all := []*HashdeepEntry{
+		{path: "same.txt", size: 1, hashes: map[string]string{"md5": "aa"}},
+		{path: "new.txt", size: 2, hashes: map[string]string{"md5": "bb"}},
+		{path: "other.txt", size: 5, hashes: map[string]string{"md5": "cc"}},
+		{path: "unknown.txt", size: 6, hashes: map[string]string{"md5": "ee"}},
+		{path: "archived.txt", size: 7, status: "archived"},
+	}
+	exact := []*HashdeepEntry{
+		{path: "same.txt", size: 1, hashes: map[string]string{"md5": "aa"}},
+		{path: "old.txt", size: 2, hashes: map[string]string{"md5": "bb"}},
+		{path: "partial.txt", size: 3, hashes: map[string]string{"md5": "cc"}},
+		{path: "gone.txt", size: 4, hashes: map[string]string{"md5": "dd"}},
+	}
+
+	tests := []struct {
+		name       string
+		mode       string
+		verbosity  int
+		entries    []*HashdeepEntry
+		want       string
+		wantFailed bool
+	}{
+		{
+			name:    "audit passed",
+			mode:    ModeAudit,
+			entries: exact,
+			want:    "az-blob-hashdeep: Audit passed\n",
+		},
+		{
+			name:       "audit failed",
+			mode:       ModeAudit,
+			entries:    all,
+			want:       "az-blob-hashdeep: Audit failed\n",
+			wantFailed: true,
+		},
+		{
+			name:      "audit counts",
+			mode:      ModeAudit,
+			verbosity: 1,
+			entries:   all,
+			want: "az-blob-hashdeep: Audit failed\n" +
+				"          Files matched: 1\n" +
+				"Files partially matched: 1\n" +
+				"            Files moved: 1\n" +
+				"        New files found: 1\n" +
+				"  Known files not found: 1\n" +
+				"       Files not hashed: 1\n",
+			wantFailed: true,
+		},
+		{
+			name:      "audit every file",
+			mode:      ModeAudit,
+			verbosity: 2,
+			entries:   all,
+			want: "new.txt: Moved from old.txt\n" +
+				"other.txt: Partial match with partial.txt\n" +
+				"unknown.txt: No match\n" +
+				"archived.txt: Not hashed, archived\n" +
+				"gone.txt: Known file not used\n" +
+				"az-blob-hashdeep: Audit failed\n" +
+				"          Files matched: 1\n" +
+				"Files partially matched: 1\n" +
+				"            Files moved: 1\n" +
+				"        New files found: 1\n" +
+				"  Known files not found: 1\n" +
+				"       Files not hashed: 1\n",
+			wantFailed: true,
+		},
+		{
+			name:      "passed audit counts without not hashed",
+			mode:      ModeAudit,
+			verbosity: 1,
+			entries:   exact,
+			want: "az-blob-hashdeep: Audit passed\n" +
+				"          Files matched: 4\n" +
+				"Files partially matched: 0\n" +
+				"            Files moved: 0\n" +
+				"        New files found: 0\n" +
+				"  Known files not found: 0\n",
+		},
+		{
+			name:    "match",
+			mode:    ModeMatch,
+			entries: all,
+			want:    "same.txt\nnew.txt\nother.txt\n",
+		},
+		{
+			name:    "negative match",
+			mode:    ModeNegativeMatch,
+			entries: all,
+			want:    "unknown.txt\n",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			knownFile := filepath.Join(dir, "known.hashdeep")
+			if err := os.WriteFile(knownFile, []byte(known), 0644); err != nil {
+				t.Fatal(err)
+			}
+			knownHashes, err := loadKnownHashes([]string{knownFile}, []string{"md5"})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			output := filepath.Join(dir, "audit.txt")
+			a := &AuditOutputFile{OutputFile: output, Mode: test.mode, Verbosity: test.verbosity, Known: knownHashes}
+			if err := a.Open(); err != nil {
+				t.Fatal(err)
+			}
+			for _, e := range test.entries {
+				if err := a.WriteEntry(e); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := a.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := os.ReadFile(output)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != test.want {
+				t.Errorf("wrote\n%s\nwant\n%s", got, test.want)
+			}
+			if a.Failed() != test.wantFailed {
+				t.Errorf("Failed() = %v, want %v", a.Failed(), test.wantFailed)
+			}
+		})
+	}
+}
+
+func TestKnownHashesMatch(t *testing.T) {
+	known := &knownHashes{byHash: make(map[string][]*knownFile)}
+	for _, e := range []*HashdeepEntry{
+		{path: "a", size: 1, hashes: map[string]string{"md5": "aa", "sha1": "a1"}},
+		{path: "b", size: 2, hashes: map[string]string{"md5": "bb", "sha1": "b1"}},
+	} {
+		f := &knownFile{entry: &hashdeep.Entry{Size: e.size, Hashes: e.hashes, Path: e.path}}
+		known.files = append(known.files, f)
+		for algorithm, value := range e.hashes {
+			known.byHash[algorithm+":"+value] = append(known.byHash[algorithm+":"+value], f)
+		}
+	}
+
+	tests := []struct {
+		name     string
+		path     string
+		size     int64
+		hashes   map[string]string
+		want     matchStatus
+		wantPath string
+	}{
+		{name: "exact", path: "a", size: 1, hashes: map[string]string{"md5": "aa", "sha1": "a1"}, want: statusExactMatch, wantPath: "a"},
+		{name: "moved", path: "c", size: 1, hashes: map[string]string{"md5": "aa", "sha1": "a1"}, want: statusFileMoved, wantPath: "a"},
+		{name: "other size", path: "a", size: 9, hashes: map[string]string{"md5": "aa", "sha1": "a1"}, want: statusPartialMatch, wantPath: "a"},
+		{name: "one of two digests", path: "a", size: 1, hashes: map[string]string{"md5": "aa", "sha1": "xx"}, want: statusPartialMatch, wantPath: "a"},
+		{name: "exact beats moved", path: "b", size: 2, hashes: map[string]string{"md5": "bb", "sha1": "b1"}, want: statusExactMatch, wantPath: "b"},
+		{name: "unknown", path: "a", size: 1, hashes: map[string]string{"md5": "zz", "sha1": "zz"}, want: statusNoMatch},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			status, f := known.match(test.path, test.size, test.hashes)
+			if status != test.want {
+				t.Errorf("match() = %v, want %v", status, test.want)
+			}
+			if (f == nil) != (test.wantPath == "") || (f != nil && f.entry.Path != test.wantPath) {
+				t.Errorf("match() matched %+v, want %q", f, test.wantPath)
+			}
+		})
+	}
+}
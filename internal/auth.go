@@ -0,0 +1,239 @@
+/*
+Copyright © 2019 Even Holthe
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+	"github.com/pkg/errors"
+)
+
+// Authentication methods
+const (
+	AuthSharedKey         = "shared-key"
+	AuthSas               = "sas"
+	AuthClientSecret      = "client-secret"
+	AuthClientCertificate = "client-certificate"
+	AuthWorkloadIdentity  = "workload-identity"
+	AuthManagedIdentity   = "managed-identity"
+	AuthAzureCLI          = "azure-cli"
+)
+
+// Entra ID authority hosts of the Azure clouds
+var cloudAuthorityHosts = map[string]azidentity.AuthorityHost{
+	CloudPublic: azidentity.AzurePublicCloud,
+	"china":     azidentity.AzureChina,
+	"usgov":     azidentity.AzureGovernment,
+}
+
+// Fills in Entra ID settings left empty from the environment variables used by the Azure SDKs
+func applyAuthEnvironment(c *TraversalConfig) {
+	setIfEmpty(&c.TenantID, os.Getenv("AZURE_TENANT_ID"))
+	setIfEmpty(&c.ClientID, os.Getenv("AZURE_CLIENT_ID"))
+	setIfEmpty(&c.ClientSecret, os.Getenv("AZURE_CLIENT_SECRET"))
+	setIfEmpty(&c.ClientCertificate, os.Getenv("AZURE_CLIENT_CERTIFICATE_PATH"))
+	setIfEmpty(&c.ClientCertificatePassword, os.Getenv("AZURE_CLIENT_CERTIFICATE_PASSWORD"))
+	setIfEmpty(&c.FederatedTokenFile, os.Getenv("AZURE_FEDERATED_TOKEN_FILE"))
+}
+
+func validateAuth(c *TraversalConfig) error {
+	applyAuthEnvironment(c)
+
+	if c.Auth == "" {
+		switch {
+		case c.SasToken != "":
+			c.Auth = AuthSas
+		case c.AccountKey != "":
+			c.Auth = AuthSharedKey
+		default:
+			return errors.New("either account key, SAS token or another authentication method must be specified")
+		}
+	}
+
+	required := map[string]string{}
+	switch c.Auth {
+	case AuthSharedKey:
+		required["account key"] = c.AccountKey
+	case AuthSas:
+		required["SAS token"] = c.SasToken
+	case AuthClientSecret:
+		required["tenant ID"] = c.TenantID
+		required["client ID"] = c.ClientID
+		required["client secret"] = c.ClientSecret
+	case AuthClientCertificate:
+		required["tenant ID"] = c.TenantID
+		required["client ID"] = c.ClientID
+		required["client certificate"] = c.ClientCertificate
+	case AuthWorkloadIdentity:
+		required["tenant ID"] = c.TenantID
+		required["client ID"] = c.ClientID
+		required["federated token file"] = c.FederatedTokenFile
+	case AuthManagedIdentity, AuthAzureCLI:
+	default:
+		return errors.Errorf("unknown authentication method '%s'", c.Auth)
+	}
+
+	for name, value := range required {
+		if value == "" {
+			return errors.Errorf("%s must be specified when authenticating with %s", name, c.Auth)
+		}
+	}
+
+	return nil
+}
+
+// Returns the Entra ID credential for token based authentication methods
+func tokenCredential(c *TraversalConfig) (azcore.TokenCredential, error) {
+	authorityHost := cloudAuthorityHosts[c.Cloud]
+
+	switch c.Auth {
+	case AuthClientSecret:
+		return azidentity.NewClientSecretCredential(c.TenantID, c.ClientID, c.ClientSecret, &azidentity.ClientSecretCredentialOptions{
+			AuthorityHost: authorityHost,
+		})
+	case AuthClientCertificate:
+		data, err := os.ReadFile(c.ClientCertificate)
+		if err != nil {
+			return nil, errors.Wrap(err, "could not read client certificate")
+		}
+
+		certs, key, err := azidentity.ParseCertificates(data, []byte(c.ClientCertificatePassword))
+		if err != nil {
+			return nil, errors.Wrap(err, "could not parse client certificate")
+		}
+
+		return azidentity.NewClientCertificateCredential(c.TenantID, c.ClientID, certs, key, &azidentity.ClientCertificateCredentialOptions{
+			AuthorityHost: authorityHost,
+		})
+	case AuthWorkloadIdentity:
+		return &workloadIdentityCredential{
+			client:        &http.Client{Timeout: tokenRequestTimeout},
+			authorityHost: string(authorityHost),
+			tenantID:      c.TenantID,
+			clientID:      c.ClientID,
+			tokenFile:     c.FederatedTokenFile,
+		}, nil
+	case AuthManagedIdentity:
+		opts := &azidentity.ManagedIdentityCredentialOptions{}
+		if c.ClientID != "" {
+			opts.ID = azidentity.ClientID(c.ClientID)
+		}
+
+		return azidentity.NewManagedIdentityCredential(opts)
+	case AuthAzureCLI:
+		return azidentity.NewAzureCLICredential(&azidentity.AzureCLICredentialOptions{TenantID: c.TenantID})
+	}
+
+	return nil, errors.Errorf("authentication method '%s' is not token based", c.Auth)
+}
+
+// Exchanges a federated token, e.g. a Kubernetes service account token, for an access token.
+type workloadIdentityCredential struct {
+	client        *http.Client
+	authorityHost string
+	tenantID      string
+	clientID      string
+	tokenFile     string
+
+	mu     sync.Mutex
+	cached *azcore.AccessToken
+}
+
+// Access tokens are renewed this long before they expire
+const tokenRefreshMargin = 5 * time.Minute
+
+// Token requests that take longer fail, instead of hanging the run
+const tokenRequestTimeout = time.Minute
+
+func (w *workloadIdentityCredential) GetToken(ctx context.Context, options policy.TokenRequestOptions) (*azcore.AccessToken, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.cached != nil && time.Until(w.cached.ExpiresOn) > tokenRefreshMargin {
+		return w.cached, nil
+	}
+
+	// The token file is rotated, so it has to be read every time
+	assertion, err := os.ReadFile(w.tokenFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not read federated token file")
+	}
+
+	authorityHost := w.authorityHost
+	if authorityHost == "" {
+		authorityHost = os.Getenv("AZURE_AUTHORITY_HOST")
+	}
+	if authorityHost == "" {
+		authorityHost = string(azidentity.AzurePublicCloud)
+	}
+
+	tenantID := w.tenantID
+	if options.TenantID != "" {
+		tenantID = options.TenantID
+	}
+
+	form := url.Values{
+		"grant_type":            {"client_credentials"},
+		"client_id":             {w.clientID},
+		"client_assertion_type": {"urn:ietf:params:oauth:client-assertion-type:jwt-bearer"},
+		"client_assertion":      {strings.TrimSpace(string(assertion))},
+		"scope":                 {strings.Join(options.Scopes, " ")},
+	}
+	tokenURL := fmt.Sprintf("%s/%s/oauth2/v2.0/token", strings.TrimSuffix(authorityHost, "/"), url.PathEscape(tenantID))
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not request access token")
+	}
+	defer resp.Body.Close()
+
+	var body struct {
+		AccessToken      string `json:"access_token"`
+		ExpiresIn        int64  `json:"expires_in"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, errors.Wrapf(err, "could not decode token response (HTTP %d)", resp.StatusCode)
+	}
+	if resp.StatusCode != http.StatusOK || body.AccessToken == "" {
+		return nil, errors.Errorf("token request failed (HTTP %d): %s %s", resp.StatusCode, body.Error, body.ErrorDescription)
+	}
+
+	w.cached = &azcore.AccessToken{
+		Token:     body.AccessToken,
+		ExpiresOn: time.Now().Add(time.Duration(body.ExpiresIn) * time.Second),
+	}
+
+	return w.cached, nil
+}
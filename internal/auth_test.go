@@ -0,0 +1,99 @@
+/*
+Copyright © 2019 Even Holthe
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package internal
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+)
+
+func TestWorkloadIdentityCredential(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenFile, []byte("assertion\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		want    string
+		wantErr string
+	}{
+		{
+			name: "token",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != "/tenant/oauth2/v2.0/token" || r.FormValue("client_assertion") != "assertion" || r.FormValue("client_id") != "client" {
+					w.WriteHeader(http.StatusBadRequest)
+				}
+				_, _ = w.Write([]byte(`{"access_token":"secret","expires_in":3600}`))
+			},
+			want: "secret",
+		},
+		{
+			name: "error response",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusUnauthorized)
+				_, _ = w.Write([]byte(`{"error":"invalid_client","error_description":"no such client"}`))
+			},
+			wantErr: "HTTP 401): invalid_client no such client",
+		},
+		{
+			name: "hanging endpoint",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				// The request context only ends with the connection once the body is read
+				_ = r.ParseForm()
+				<-r.Context().Done()
+			},
+			wantErr: "could not request access token",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := httptest.NewServer(test.handler)
+			defer server.Close()
+
+			credential := &workloadIdentityCredential{
+				client:        &http.Client{Timeout: 100 * time.Millisecond},
+				authorityHost: server.URL,
+				tenantID:      "tenant",
+				clientID:      "client",
+				tokenFile:     tokenFile,
+			}
+			token, err := credential.GetToken(context.Background(), policy.TokenRequestOptions{Scopes: []string{"https://storage.azure.com/.default"}})
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("GetToken() error = %v, want %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if token.Token != test.want {
+				t.Errorf("GetToken() = %s, want %s", token.Token, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,297 @@
+/*
+Copyright © 2019 Even Holthe
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// Stored next to the output file while a run is in progress
+const checkpointSuffix = ".checkpoint"
+
+// A checkpoint is a journal of JSON lines, one record per sync of the output
+// file. A record is written after the output file has been flushed, so the
+// output file can safely be truncated to the latest recorded offset.
+type checkpointRecord struct {
+	// Size of the output file, the state file and the manifest of deleted
+	// blobs when the record was written
+	Offset        int64 `json:"offset"`
+	StateOffset   int64 `json:"state_offset,omitempty"`
+	DeletedOffset int64 `json:"deleted_offset,omitempty"`
+	// Source, listing prefix and marker of the oldest page with blobs still
+	// being hashed, and the first blob name in that page, see source.key
+	Source string `json:"source,omitempty"`
+	Prefix string `json:"prefix,omitempty"`
+	Marker string `json:"marker,omitempty"`
+	From   string `json:"from,omitempty"`
+	// Blobs written to the output file since the previous record
+	Completed []string `json:"completed,omitempty"`
+}
+
+// A page of the container listing, tracked until all of its blobs are written
+type listedPage struct {
+	source  string
+	prefix  string
+	marker  string
+	first   string
+	pending int
+}
+
+// checkpoint records the progress of a generate run so it can be resumed.
+// Blobs are listed in name order, so resuming from the marker of the oldest
+// unfinished page and skipping the completed blobs from that page onwards
+// gives the same result as an uninterrupted run.
+type checkpoint struct {
+	path string
+	file *os.File
+
+	mu sync.Mutex
+	// Resume state, as of the latest record
+	source        string
+	prefix        string
+	marker        string
+	from          string
+	offset        int64
+	stateOffset   int64
+	deletedOffset int64
+	done          map[string]bool
+
+	pages     []*listedPage
+	pageOf    map[string]*listedPage
+	completed []string
+	// Set when the listing has been exhausted
+	listingDone bool
+	// Set by close when every listed blob was written
+	finished bool
+}
+
+// Creates an empty checkpoint, refusing to overwrite one from an earlier run
+func newCheckpoint(path string) (*checkpoint, error) {
+	file, err := createOutputFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not create checkpoint '%s'", path)
+	}
+
+	return &checkpoint{
+		path:   path,
+		file:   file,
+		done:   make(map[string]bool),
+		pageOf: make(map[string]*listedPage),
+	}, nil
+}
+
+// Loads the checkpoint of an interrupted run. A partially written record at
+// the end, e.g. after the process was killed, is discarded.
+func loadCheckpoint(path string) (*checkpoint, error) {
+	file, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not open checkpoint '%s'", path)
+	}
+
+	c := &checkpoint{
+		path:   path,
+		file:   file,
+		done:   make(map[string]bool),
+		pageOf: make(map[string]*listedPage),
+	}
+
+	// First pass: find the latest complete record and where it ends
+	var (
+		latest checkpointRecord
+		length int64
+		count  int
+	)
+	err = readCheckpointRecords(file, func(r *checkpointRecord, end int64) {
+		latest = *r
+		length = end
+		count++
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not read checkpoint '%s'", path)
+	}
+	if count == 0 {
+		return nil, errors.Errorf("checkpoint '%s' contains no progress", path)
+	}
+
+	c.source, c.prefix, c.marker, c.from = latest.Source, latest.Prefix, latest.Marker, latest.From
+	c.offset, c.stateOffset, c.deletedOffset = latest.Offset, latest.StateOffset, latest.DeletedOffset
+
+	// Second pass: only blobs from the resume page onwards are relevant
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	err = readCheckpointRecords(io.LimitReader(file, length), func(r *checkpointRecord, _ int64) {
+		for _, name := range r.Completed {
+			if name >= c.from {
+				c.done[name] = true
+			}
+		}
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not read checkpoint '%s'", path)
+	}
+
+	if err := file.Truncate(length); err != nil {
+		return nil, err
+	}
+	if _, err := file.Seek(length, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// Calls fn with every complete record and the offset of its end
+func readCheckpointRecords(r io.Reader, fn func(r *checkpointRecord, end int64)) error {
+	reader := bufio.NewReader(r)
+	var offset int64
+
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			// Anything without a trailing newline was never fully written
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		record := &checkpointRecord{}
+		if err := json.Unmarshal(bytes.TrimSpace(line), record); err != nil {
+			return errors.Wrapf(err, "corrupt record at offset %d", offset)
+		}
+
+		offset += int64(len(line))
+		fn(record, offset)
+	}
+}
+
+// Returns the source to resume from, sources before it are complete
+func (c *checkpoint) resumeSource() string {
+	return c.source
+}
+
+// Returns the listing prefix of resumeSource to resume from, prefixes before it are complete
+func (c *checkpoint) resumePrefix() string {
+	return c.prefix
+}
+
+// Returns the marker to resume the listing of resumePrefix from, empty to start from the beginning
+func (c *checkpoint) resumeMarker() string {
+	return c.marker
+}
+
+// Reports whether a blob was written to the output file by an earlier run
+func (c *checkpoint) skip(name string) bool {
+	return c.done[name]
+}
+
+// Registers a page of the listing before its blobs are queued for hashing
+func (c *checkpoint) listed(source string, prefix string, marker string, first string, names []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	page := &listedPage{source: source, prefix: prefix, marker: marker, first: first, pending: len(names)}
+	for _, name := range names {
+		c.pageOf[name] = page
+	}
+	c.pages = append(c.pages, page)
+	c.advance()
+}
+
+// Registers a blob as written to the output file
+func (c *checkpoint) complete(name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.completed = append(c.completed, name)
+	if page, ok := c.pageOf[name]; ok {
+		page.pending--
+		delete(c.pageOf, name)
+	}
+	c.advance()
+}
+
+// Registers that every page of the listing has been queued
+func (c *checkpoint) finishListing() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.listingDone = true
+}
+
+// Moves the resume point past finished pages, keeping the latest page so
+// there is always a marker to resume from
+func (c *checkpoint) advance() {
+	for len(c.pages) > 1 && c.pages[0].pending == 0 {
+		c.pages = c.pages[1:]
+	}
+
+	if len(c.pages) > 0 {
+		c.source, c.prefix, c.marker, c.from = c.pages[0].source, c.pages[0].prefix, c.pages[0].marker, c.pages[0].first
+	}
+}
+
+// Appends a record for everything completed so far and commits it to disk.
+// The output file, state file and manifest of deleted blobs must be synced up
+// to their offsets beforehand.
+func (c *checkpoint) sync(offset int64, stateOffset int64, deletedOffset int64) error {
+	c.mu.Lock()
+	record := checkpointRecord{Offset: offset, StateOffset: stateOffset, DeletedOffset: deletedOffset, Source: c.source, Prefix: c.prefix, Marker: c.marker, From: c.from, Completed: c.completed}
+	c.completed = nil
+	c.mu.Unlock()
+
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	if _, err := c.file.Write(append(line, '\n')); err != nil {
+		return errors.Wrapf(err, "could not write checkpoint '%s'", c.path)
+	}
+	if err := c.file.Sync(); err != nil {
+		return errors.Wrapf(err, "could not sync checkpoint '%s'", c.path)
+	}
+
+	return nil
+}
+
+// Closes the checkpoint, removing it when the run is complete
+func (c *checkpoint) close() error {
+	if err := c.file.Close(); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	c.finished = c.listingDone && len(c.pageOf) == 0
+	finished := c.finished
+	c.mu.Unlock()
+
+	if !finished {
+		log.Warnf("run is incomplete, resume with --resume using checkpoint %s", c.path)
+		return nil
+	}
+
+	return os.Remove(c.path)
+}
@@ -0,0 +1,124 @@
+/*
+Copyright © 2019 Even Holthe
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package internal
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestLoadCheckpoint(t *testing.T) {
+	record := func(r checkpointRecord) string {
+		line, err := json.Marshal(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(line) + "\n"
+	}
+	first := record(checkpointRecord{Offset: 100, StateOffset: 50, Marker: "", From: "a", Completed: []string{"a", "b"}})
+	second := record(checkpointRecord{Offset: 200, StateOffset: 90, DeletedOffset: 40, Prefix: "p/", Marker: "m", From: "c", Completed: []string{"d", "c"}})
+
+	tests := []struct {
+		name       string
+		journal    string
+		wantLength int
+		wantMarker string
+		wantOffset int64
+		wantDone   []string
+		wantErr    string
+	}{
+		{
+			name:       "complete records",
+			journal:    first + second,
+			wantLength: len(first + second),
+			wantMarker: "m",
+			wantOffset: 200,
+			wantDone:   []string{"c", "d"},
+		},
+		{
+			name:       "cut off mid-record",
+			journal:    first + second + `{"offset":300,"marker":"x","completed":["e`,
+			wantLength: len(first + second),
+			wantMarker: "m",
+			wantOffset: 200,
+			wantDone:   []string{"c", "d"},
+		},
+		{
+			name:       "cut off before the newline",
+			journal:    first + strings.TrimSuffix(second, "\n"),
+			wantLength: len(first),
+			wantOffset: 100,
+			wantDone:   []string{"a", "b"},
+		},
+		{
+			name:    "no complete record",
+			journal: `{"offset":100`,
+			wantErr: "contains no progress",
+		},
+		{
+			name:    "corrupt record",
+			journal: first + "garbage\n" + second,
+			wantErr: "corrupt record at offset",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "out.hashdeep"+checkpointSuffix)
+			if err := os.WriteFile(path, []byte(test.journal), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			c, err := loadCheckpoint(path)
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("loadCheckpoint() error = %v, want %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.file.Close()
+
+			if c.resumeMarker() != test.wantMarker || c.offset != test.wantOffset {
+				t.Errorf("resume from marker %q at offset %d, want %q at %d", c.resumeMarker(), c.offset, test.wantMarker, test.wantOffset)
+			}
+			var done []string
+			for name := range c.done {
+				done = append(done, name)
+			}
+			sort.Strings(done)
+			if !reflect.DeepEqual(done, test.wantDone) {
+				t.Errorf("done = %v, want %v", done, test.wantDone)
+			}
+
+			// The partial record is discarded, so the next one starts on a line of its own
+			info, err := os.Stat(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Size() != int64(test.wantLength) {
+				t.Errorf("journal is %d bytes, want %d", info.Size(), test.wantLength)
+			}
+		})
+	}
+}
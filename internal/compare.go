@@ -0,0 +1,394 @@
+/*
+Copyright © 2019 Even Holthe
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package internal
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/evenh/az-blob-hashdeep/internal/hashdeep"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	statusIdentical      = "identical"
+	statusContentChanged = "content-changed"
+	statusSizeChanged    = "size-changed"
+	statusOnlyInLeft     = "only-in-left"
+	statusOnlyInRight    = "only-in-right"
+	statusMoved          = "moved"
+)
+
+type compareResult map[string]uint64
+
+func (r compareResult) failed() bool {
+	for status, count := range r {
+		if status != statusIdentical && count > 0 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Writes one tab separated line per difference, e.g. "moved\told/path\tnew/path"
+type compareReport struct {
+	writer        *bufio.Writer
+	showIdentical bool
+	result        compareResult
+}
+
+func (r *compareReport) add(status string, paths ...string) error {
+	r.result[status]++
+	if status == statusIdentical && !r.showIdentical {
+		return nil
+	}
+
+	_, err := r.writer.WriteString(status + "\t" + strings.Join(paths, "\t") + "\n")
+	return err
+}
+
+// Compare diffs two hashdeep files. Both files are sorted externally, so
+// neither of them has to fit in memory.
+func Compare(ctx context.Context, c *CompareConfig) {
+	logger := log.WithField("phase", "compare")
+
+	out := os.Stdout
+	if c.OutputFile != "" {
+		file, err := os.Create(c.OutputFile)
+		if err != nil {
+			log.Fatalf("error while configuring output: %v", err)
+		}
+		defer file.Close()
+		out = file
+	}
+
+	report := &compareReport{
+		writer:        bufio.NewWriterSize(out, 64*1024),
+		showIdentical: c.ShowIdentical,
+		result:        make(compareResult),
+	}
+
+	if err := compareFiles(ctx, c, report); err != nil {
+		log.Fatalf("error while comparing: %v", err)
+	}
+
+	if err := report.writer.Flush(); err != nil {
+		log.Fatalf("could not flush report: %v", err)
+	}
+
+	logger.Infof("identical: %d, content changed: %d, size changed: %d, moved: %d, only in left: %d, only in right: %d",
+		report.result[statusIdentical], report.result[statusContentChanged], report.result[statusSizeChanged],
+		report.result[statusMoved], report.result[statusOnlyInLeft], report.result[statusOnlyInRight])
+
+	if report.result.failed() {
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+func compareFiles(ctx context.Context, c *CompareConfig, report *compareReport) error {
+	logger := log.WithField("phase", "compare")
+
+	left, leftAlgorithms, err := sortHashdeepFile(ctx, c.LeftFile, c.LeftStrip, byPath, c)
+	if err != nil {
+		return err
+	}
+	defer left.Close()
+
+	right, rightAlgorithms, err := sortHashdeepFile(ctx, c.RightFile, c.RightStrip, byPath, c)
+	if err != nil {
+		return err
+	}
+	defer right.Close()
+
+	primary := ""
+	for _, algorithm := range leftAlgorithms {
+		if contains(rightAlgorithms, algorithm) {
+			primary = algorithm
+			break
+		}
+	}
+	if primary == "" {
+		return errors.Errorf("the files have no hash algorithms in common (%s vs. %s)",
+			strings.Join(leftAlgorithms, ","), strings.Join(rightAlgorithms, ","))
+	}
+	logger.Debugf("using %s to detect moved files", primary)
+
+	byHash := func(a, b *hashdeep.Entry) bool {
+		if a.Size != b.Size {
+			return a.Size < b.Size
+		}
+		if a.Hashes[primary] != b.Hashes[primary] {
+			return a.Hashes[primary] < b.Hashes[primary]
+		}
+		return a.Path < b.Path
+	}
+
+	onlyLeft := newExternalSorter(byHash, c.ChunkSize, c.TempDir)
+	defer onlyLeft.Close()
+	onlyRight := newExternalSorter(byHash, c.ChunkSize, c.TempDir)
+	defer onlyRight.Close()
+
+	// Phase 1: join by path
+	logger.Info("comparing entries by path")
+	leftIt, err := left.Sort()
+	if err != nil {
+		return err
+	}
+	rightIt, err := right.Sort()
+	if err != nil {
+		return err
+	}
+
+	err = mergeJoin(ctx, leftIt, rightIt, func(a, b *hashdeep.Entry) int {
+		return strings.Compare(a.Path, b.Path)
+	}, func(l, r *hashdeep.Entry) error {
+		switch {
+		case r == nil:
+			return onlyLeft.Add(l)
+		case l == nil:
+			return onlyRight.Add(r)
+		case l.Size != r.Size:
+			return report.add(statusSizeChanged, l.Path)
+		case !sameHashes(l, r):
+			return report.add(statusContentChanged, l.Path)
+		default:
+			return report.add(statusIdentical, l.Path)
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	// Phase 2: join what is left by size and hash to find moved files
+	logger.Info("looking for moved files")
+	unmatchedLeft := newExternalSorter(byPath, c.ChunkSize, c.TempDir)
+	defer unmatchedLeft.Close()
+	unmatchedRight := newExternalSorter(byPath, c.ChunkSize, c.TempDir)
+	defer unmatchedRight.Close()
+
+	leftIt, err = onlyLeft.Sort()
+	if err != nil {
+		return err
+	}
+	rightIt, err = onlyRight.Sort()
+	if err != nil {
+		return err
+	}
+
+	err = mergeJoin(ctx, leftIt, rightIt, func(a, b *hashdeep.Entry) int {
+		switch {
+		case a.Size < b.Size:
+			return -1
+		case a.Size > b.Size:
+			return 1
+		}
+		// Entries without the hash cannot be paired up
+		if a.Hashes[primary] == "" {
+			return -1
+		}
+		if b.Hashes[primary] == "" {
+			return 1
+		}
+		return strings.Compare(a.Hashes[primary], b.Hashes[primary])
+	}, func(l, r *hashdeep.Entry) error {
+		switch {
+		case r == nil:
+			return unmatchedLeft.Add(l)
+		case l == nil:
+			return unmatchedRight.Add(r)
+		default:
+			return report.add(statusMoved, l.Path, r.Path)
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	// Phase 3: report the rest in path order
+	for _, unmatched := range []struct {
+		sorter *externalSorter
+		status string
+	}{
+		{unmatchedLeft, statusOnlyInLeft},
+		{unmatchedRight, statusOnlyInRight},
+	} {
+		it, err := unmatched.sorter.Sort()
+		if err != nil {
+			return err
+		}
+
+		for {
+			e, err := it.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return err
+			}
+
+			if err := report.add(unmatched.status, e.Path); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func byPath(a, b *hashdeep.Entry) bool {
+	return a.Path < b.Path
+}
+
+// Reads a hashdeep file into an external sorter, returning it along with the
+// declared algorithms. The strip prefix is removed from the paths having it.
+func sortHashdeepFile(ctx context.Context, path string, strip string, less entryLess, c *CompareConfig) (*externalSorter, []string, error) {
+	logger := log.WithField("phase", "compare")
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer file.Close()
+
+	reader := hashdeep.NewReader(file)
+	algorithms, err := reader.Algorithms()
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "could not parse '%s'", path)
+	}
+
+	sorter := newExternalSorter(less, c.ChunkSize, c.TempDir)
+	var count, unstripped uint64 = 0, 0
+
+	for {
+		if ctx.Err() != nil {
+			sorter.Close()
+			return nil, nil, ctx.Err()
+		}
+
+		entry, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			sorter.Close()
+			return nil, nil, errors.Wrapf(err, "could not parse '%s'", path)
+		}
+
+		if strip != "" {
+			if strings.HasPrefix(entry.Path, strip) {
+				entry.Path = strings.TrimPrefix(entry.Path, strip)
+			} else {
+				unstripped++
+			}
+		}
+
+		if err := sorter.Add(entry); err != nil {
+			sorter.Close()
+			return nil, nil, err
+		}
+		count++
+	}
+	logger.Infof("read %d entries from %s", count, path)
+	if unstripped > 0 {
+		logger.Warnf("%d paths in %s do not start with %s and were compared as they are", unstripped, path, strip)
+	}
+
+	return sorter, algorithms, nil
+}
+
+// Walks two sorted iterators in lockstep, calling fn with both entries when
+// they compare as equal and with nil for the side an entry is missing from.
+// Runs of equal keys are paired up in order.
+func mergeJoin(ctx context.Context, left entryIterator, right entryIterator, compare func(a, b *hashdeep.Entry) int, fn func(l, r *hashdeep.Entry) error) error {
+	next := func(it entryIterator) (*hashdeep.Entry, error) {
+		e, err := it.Next()
+		if err == io.EOF {
+			return nil, nil
+		}
+		return e, err
+	}
+
+	l, err := next(left)
+	if err != nil {
+		return err
+	}
+	r, err := next(right)
+	if err != nil {
+		return err
+	}
+
+	for l != nil || r != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		var cmp int
+		switch {
+		case r == nil:
+			cmp = -1
+		case l == nil:
+			cmp = 1
+		default:
+			cmp = compare(l, r)
+		}
+
+		switch {
+		case cmp < 0:
+			err = fn(l, nil)
+		case cmp > 0:
+			err = fn(nil, r)
+		default:
+			err = fn(l, r)
+		}
+		if err != nil {
+			return err
+		}
+
+		if cmp <= 0 {
+			if l, err = next(left); err != nil {
+				return err
+			}
+		}
+		if cmp >= 0 {
+			if r, err = next(right); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Compares the hash algorithms present in both entries
+func sameHashes(a, b *hashdeep.Entry) bool {
+	compared := 0
+	for algorithm, value := range a.Hashes {
+		if other, ok := b.Hashes[algorithm]; ok {
+			if !strings.EqualFold(value, other) {
+				return false
+			}
+			compared++
+		}
+	}
+
+	return compared > 0
+}
@@ -0,0 +1,174 @@
+/*
+Copyright © 2019 Even Holthe
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/evenh/az-blob-hashdeep/internal/hashdeep"
+)
+
+func TestExternalSorter(t *testing.T) {
+	for _, chunkSize := range []int{1, 3, 100} {
+		t.Run(fmt.Sprintf("chunk size %d", chunkSize), func(t *testing.T) {
+			sorter := newExternalSorter(byPath, chunkSize, t.TempDir())
+			defer sorter.Close()
+
+			var want []string
+			for i := 0; i < 20; i++ {
+				path := fmt.Sprintf("file-%02d", (i*7)%20)
+				want = append(want, path)
+				if err := sorter.Add(&hashdeep.Entry{Size: int64(i), Hashes: map[string]string{"md5": path}, Path: path}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			sort.Strings(want)
+
+			it, err := sorter.Sort()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var got []string
+			for {
+				e, err := it.Next()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				if e.Hashes["md5"] != e.Path {
+					t.Errorf("entry %s lost its hashes: %v", e.Path, e.Hashes)
+				}
+				got = append(got, e.Path)
+			}
+
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("sorted %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestCompareFiles(t *testing.T) {
+	const header = "%%%% HASHDEEP-1.0\n%%%% size,md5,filename\n## Invoked from: test\n##\n"
+
+	tests := []struct {
+		name       string
+		left       string
+		right      string
+		leftStrip  string
+		rightStrip string
+		want       []string
+	}{
+		{
+			name:  "identical",
+			left:  "1,aa,a.txt\n",
+			right: "1,aa,a.txt\n",
+			want:  []string{"identical\ta.txt"},
+		},
+		{
+			name:  "changed",
+			left:  "1,aa,content.txt\n1,bb,size.txt\n",
+			right: "1,cc,content.txt\n2,bb,size.txt\n",
+			want:  []string{"content-changed\tcontent.txt", "size-changed\tsize.txt"},
+		},
+		{
+			name:  "moved",
+			left:  "1,aa,old/a.txt\n2,bb,old/b.txt\n",
+			right: "2,bb,new/b.txt\n1,aa,new/a.txt\n",
+			want:  []string{"moved\told/a.txt\tnew/a.txt", "moved\told/b.txt\tnew/b.txt"},
+		},
+		{
+			name:  "duplicates moved in order",
+			left:  "1,aa,a1\n1,aa,a2\n1,aa,a3\n",
+			right: "1,aa,b1\n1,aa,b2\n",
+			want:  []string{"moved\ta1\tb1", "moved\ta2\tb2", "only-in-left\ta3"},
+		},
+		{
+			name:  "same hash different size is not a move",
+			left:  "1,aa,a\n",
+			right: "2,aa,b\n",
+			want:  []string{"only-in-left\ta", "only-in-right\tb"},
+		},
+		{
+			name:  "only on one side",
+			left:  "1,aa,left.txt\n3,cc,both.txt\n",
+			right: "2,bb,right.txt\n3,cc,both.txt\n",
+			want:  []string{"identical\tboth.txt", "only-in-left\tleft.txt", "only-in-right\tright.txt"},
+		},
+		{
+			name:      "strip absolute paths",
+			left:      "1,aa,/mnt/share/dir/a.txt\n2,bb,/other/b.txt\n",
+			right:     "1,aa,dir/a.txt\n2,bb,b.txt\n",
+			leftStrip: "/mnt/share/",
+			want:      []string{"identical\tdir/a.txt", "moved\t/other/b.txt\tb.txt"},
+		},
+		{
+			name:       "strip both sides",
+			left:       "1,aa,left/a.txt\n",
+			right:      "1,aa,right/a.txt\n",
+			leftStrip:  "left/",
+			rightStrip: "right/",
+			want:       []string{"identical\ta.txt"},
+		},
+	}
+
+	for _, tt := range tests {
+		for _, chunkSize := range []int{1, 1000} {
+			t.Run(fmt.Sprintf("%s/chunk size %d", tt.name, chunkSize), func(t *testing.T) {
+				dir := t.TempDir()
+				left, right := filepath.Join(dir, "left"), filepath.Join(dir, "right")
+				if err := os.WriteFile(left, []byte(header+tt.left), 0644); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(right, []byte(header+tt.right), 0644); err != nil {
+					t.Fatal(err)
+				}
+
+				c, err := NewCompareConfig(left, right, tt.leftStrip, tt.rightStrip, "", true, dir, chunkSize)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				var out bytes.Buffer
+				report := &compareReport{writer: bufio.NewWriter(&out), showIdentical: true, result: make(compareResult)}
+				if err := compareFiles(context.Background(), c, report); err != nil {
+					t.Fatal(err)
+				}
+				if err := report.writer.Flush(); err != nil {
+					t.Fatal(err)
+				}
+
+				got := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+				if !reflect.DeepEqual(got, tt.want) {
+					t.Errorf("compare reported\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(tt.want, "\n"))
+				}
+			})
+		}
+	}
+}
@@ -17,30 +17,155 @@ package internal
 
 import (
 	"errors"
+	"fmt"
+	"os"
 	"strings"
+	"time"
+
+	"github.com/evenh/az-blob-hashdeep/internal/hashes"
 )
 
-type GenerateConfig struct {
+// TraversalConfig holds everything needed to traverse a container and hash its blobs.
+//
+// The account name, key and SAS token are resolved from the following
+// sources, highest precedence first:
+//
+//  1. AccountName, AccountKey and SasToken (command line flags)
+//  2. AccountKeyFile and SasTokenFile, where "-" reads from stdin
+//  3. ConnectionString (flag or AZURE_STORAGE_CONNECTION_STRING)
+//  4. AZURE_STORAGE_ACCOUNT, AZURE_STORAGE_KEY and AZURE_STORAGE_SAS_TOKEN
+//
+// A key or SAS token from one source is never combined with a credential
+// from a lower precedence source.
+type TraversalConfig struct {
 	AccountName string
-	AccountKey  string
-	SasToken    string
 	Container   string
-	OutputFile  string
-	Prefix      string
-	Calculate   bool
+	// Traverse every container in the account matching the container
+	// patterns instead of Container, see generateAccount
+	AllContainers     bool
+	IncludeContainers []string
+	ExcludeContainers []string
+	containers        *blobFilter
+	// Hash the files below this local directory instead of a container, see listFiles
+	Directory string
+	// Succeed even if files or directories below Directory were skipped
+	// because they could not be read or are not regular files
+	IgnoreSkippedFiles bool
+	// Azure Storage connection string, filling in account, credential and endpoint fields left empty
+	ConnectionString string
+
+	// Authentication method, see the Auth* constants. Inferred from the
+	// account key or SAS token when empty.
+	Auth           string
+	AccountKey     string
+	AccountKeyFile string
+	SasToken       string
+	SasTokenFile   string
+	// Entra ID authentication
+	TenantID                  string
+	ClientID                  string
+	ClientSecret              string
+	ClientCertificate         string
+	ClientCertificatePassword string
+	FederatedTokenFile        string
+
+	// Either an Azure cloud, see cloudSuffixes, or a custom blob service endpoint
+	Cloud     string
+	Endpoint  string
+	PathStyle bool
+
+	// Prepended to every output path
+	Prefix string
+	// Only list blobs below these prefixes, optionally stripping them from output paths
+	IncludePrefixes []string
+	StripPrefix     bool
+	// Glob or regex patterns of blob names to hash and to skip, see newNamePattern
+	Include     []string
+	Exclude     []string
+	ExcludeFrom string
+	// Property filters, see blobFilter. Sizes like 10MB, times as YYYY-MM-DD or RFC 3339.
+	MinSize        string
+	MaxSize        string
+	ModifiedAfter  string
+	ModifiedBefore string
+	ContentTypes   []string
+	Tiers          []string
+	filter         *blobFilter
+	// Also hash previous versions and snapshots, see hashes.BlobID for their paths
+	IncludeVersions  bool
+	IncludeSnapshots bool
+	// Also hash soft-deleted blobs, written to a separate manifest when generating
+	IncludeDeleted bool
+
+	Calculate bool
+	// Handling of Archive tier blobs when calculating, see hashes.ArchiveSkip
+	Archive           string
+	RehydrateTier     string
+	RehydratePriority string
+	// How long to wait for rehydration before reporting blobs as rehydrating, zero to not wait
+	RehydrateWait time.Duration
+	// Persistent cache of calculated digests, optional
+	CacheFile   string
 	WorkerCount int
+	// Digest algorithms to output, see hashes.ParseAlgorithms
+	Algorithms []string
+}
+
+type GenerateConfig struct {
+	TraversalConfig
+	// Containers combined into the output instead of the traversal config,
+	// which then only holds the settings shared by every source
+	Sources    []TraversalConfig
+	OutputFile string
+	// Continue an interrupted run from the checkpoint next to the output file
+	Resume bool
+	// Write a state file next to the output file, implied by PreviousManifest
+	WriteState bool
+	// Reuse digests of unchanged blobs from the state file of this manifest
+	PreviousManifest string
+	// Known hashes to audit or match against, see Mode
+	KnownFiles []string
+	Mode       string
+	Verbosity  int
+}
+
+type VerifyConfig struct {
+	TraversalConfig
+	InputFile string
+}
+
+type VerifyLocalConfig struct {
+	TraversalConfig
+	// Compared with the container, see VerifyLocal
+	LocalDirectory string
+	// Traversal of the local directory, derived from the container traversal
+	local TraversalConfig
+}
+
+type CompareConfig struct {
+	LeftFile  string
+	RightFile string
+	// Removed from the start of the paths in either file, e.g. the absolute
+	// directory a hashdeep -r manifest was generated in
+	LeftStrip     string
+	RightStrip    string
+	OutputFile    string
+	ShowIdentical bool
+	TempDir       string
+	ChunkSize     int
 }
 
-func NewGenerateConfig(account string, key string, sasToken string, container string, outputFile string, prefix string, calculate bool, workerCount int) (*GenerateConfig, error) {
+func NewGenerateConfig(traversal TraversalConfig, sources []TraversalConfig, outputFile string, resume bool, writeState bool, previousManifest string, knownFiles []string, mode string, verbosity int) (*GenerateConfig, error) {
 	config := &GenerateConfig{
-		AccountName: account,
-		AccountKey:  key,
-		SasToken:    sasToken,
-		Container:   container,
-		OutputFile:  outputFile,
-		Prefix:      prefix,
-		Calculate:   calculate,
-		WorkerCount: workerCount,
+		TraversalConfig:  traversal,
+		Sources:          sources,
+		OutputFile:       outputFile,
+		Resume:           resume,
+		WriteState:       writeState || previousManifest != "",
+		PreviousManifest: previousManifest,
+		KnownFiles:       knownFiles,
+		Mode:             mode,
+		Verbosity:        verbosity,
 	}
 
 	if err := config.Validate(); err != nil {
@@ -50,26 +175,347 @@ func NewGenerateConfig(account string, key string, sasToken string, container st
 	return config, nil
 }
 
-func (c *GenerateConfig) Validate() error {
-	if c.Container == "" {
+func NewVerifyConfig(traversal TraversalConfig, inputFile string) (*VerifyConfig, error) {
+	config := &VerifyConfig{
+		TraversalConfig: traversal,
+		InputFile:       inputFile,
+	}
+
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+
+	return config, nil
+}
+
+func NewVerifyLocalConfig(traversal TraversalConfig, localDirectory string) (*VerifyLocalConfig, error) {
+	config := &VerifyLocalConfig{
+		TraversalConfig: traversal,
+		LocalDirectory:  localDirectory,
+	}
+
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+
+	return config, nil
+}
+
+func NewCompareConfig(leftFile string, rightFile string, leftStrip string, rightStrip string, outputFile string, showIdentical bool, tempDir string, chunkSize int) (*CompareConfig, error) {
+	config := &CompareConfig{
+		LeftFile:      leftFile,
+		RightFile:     rightFile,
+		LeftStrip:     leftStrip,
+		RightStrip:    rightStrip,
+		OutputFile:    outputFile,
+		ShowIdentical: showIdentical,
+		TempDir:       tempDir,
+		ChunkSize:     chunkSize,
+	}
+
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+
+	return config, nil
+}
+
+func (c *TraversalConfig) Validate() error {
+	if c.Directory != "" {
+		return c.validateDirectory()
+	}
+
+	if c.IgnoreSkippedFiles {
+		return errors.New("ignoring skipped files requires a local directory")
+	}
+
+	if err := resolveCredentials(c); err != nil {
+		return err
+	}
+
+	if c.AllContainers && c.Container != "" {
+		return errors.New("a container cannot be specified when traversing all containers")
+	}
+
+	if c.Container == "" && !c.AllContainers {
 		return errors.New("container must be specified")
 	}
 
-	if c.AccountName == "" {
-		return errors.New("account name must be specified")
+	if !c.AllContainers && (len(c.IncludeContainers) > 0 || len(c.ExcludeContainers) > 0) {
+		return errors.New("container patterns require traversing all containers")
 	}
 
-	if c.AccountKey == "" && c.SasToken == "" {
-		return errors.New("either account key or SAS token must be specified")
+	if c.AccountName == "" {
+		return errors.New("account name must be specified")
 	}
 
 	if c.SasToken != "" {
 		c.SasToken = strings.TrimPrefix(c.SasToken, "?")
 	}
 
+	if err := validateAuth(c); err != nil {
+		return err
+	}
+	registerSecrets(c.AccountKey, c.SasToken, c.ClientSecret, c.ClientCertificatePassword, c.ConnectionString)
+
+	if err := validateEndpoint(c); err != nil {
+		return err
+	}
+
+	if err := validateArchive(c); err != nil {
+		return err
+	}
+
+	if err := c.validateSelection(); err != nil {
+		return err
+	}
+
+	containers, err := newBlobFilter(c.IncludeContainers, c.ExcludeContainers)
+	if err != nil {
+		return err
+	}
+	c.containers = containers
+
+	if c.CacheFile != "" && !c.Calculate {
+		return errors.New("a hash cache is only used when calculating hashes locally")
+	}
+
+	if !c.Calculate && (len(c.Algorithms) != 1 || c.Algorithms[0] != hashes.MD5) {
+		return errors.New("only md5 is available from blob metadata, other algorithms require calculating hashes locally")
+	}
+
+	return nil
+}
+
+// Validates a traversal of a local directory, whose files are always hashed locally
+func (c *TraversalConfig) validateDirectory() error {
+	if c.Container != "" || c.AllContainers {
+		return errors.New("a container cannot be specified along with a local directory")
+	}
+
+	info, err := os.Stat(c.Directory)
+	if err != nil {
+		return fmt.Errorf("could not read local directory: %w", err)
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("'%s' is not a directory", c.Directory)
+	}
+
+	if c.IncludeVersions || c.IncludeSnapshots || c.IncludeDeleted {
+		return errors.New("versions, snapshots and deleted blobs are not available for a local directory")
+	}
+
+	if len(c.ContentTypes) > 0 || len(c.Tiers) > 0 {
+		return errors.New("content type and access tier filters are not available for a local directory")
+	}
+
+	if c.CacheFile != "" {
+		return errors.New("a hash cache is not used for a local directory")
+	}
+
+	c.Calculate = true
+
+	return c.validateSelection()
+}
+
+// Validates the prefixes, filters and algorithms selecting what is hashed
+func (c *TraversalConfig) validateSelection() error {
+	c.IncludePrefixes = normalizePrefixes(c.IncludePrefixes)
+	if c.StripPrefix && len(c.IncludePrefixes) == 0 {
+		return errors.New("stripping the prefix requires an include prefix")
+	}
+	// Blobs below different prefixes would be written with the same path
+	if c.StripPrefix && len(c.IncludePrefixes) > 1 {
+		return errors.New("only a single include prefix can be stripped")
+	}
+
+	exclude := c.Exclude
+	if c.ExcludeFrom != "" {
+		patterns, err := readPatterns(c.ExcludeFrom)
+		if err != nil {
+			return fmt.Errorf("could not read exclude patterns: %w", err)
+		}
+		exclude = append(append([]string{}, exclude...), patterns...)
+	}
+	filter, err := newBlobFilter(c.Include, exclude)
+	if err != nil {
+		return err
+	}
+	if err := filter.setProperties(c); err != nil {
+		return err
+	}
+	c.filter = filter
+
+	algorithms, err := hashes.ParseAlgorithms(c.Algorithms)
+	if err != nil {
+		return err
+	}
+	c.Algorithms = algorithms
+
+	return nil
+}
+
+func (c *GenerateConfig) Validate() error {
+	if len(c.Sources) > 0 {
+		if err := c.validateSources(); err != nil {
+			return err
+		}
+	} else if err := c.TraversalConfig.Validate(); err != nil {
+		return err
+	}
+
 	if c.OutputFile == "" {
 		return errors.New("output file must be specified")
 	}
+	// A run resumed on a later day would look for its output under another name
+	if c.Resume && strings.Contains(c.OutputFile, "{date}") {
+		return errors.New("{date} cannot be used in the output path of a resumed run, give the date of the interrupted run instead")
+	}
+	c.OutputFile = expandOutputPath(c.OutputFile, &c.TraversalConfig)
+
+	if c.Resume && c.Mode != ModeNone {
+		return errors.New("only plain output can be resumed, not audit or matching mode")
+	}
+
+	if c.IncludeDeleted && c.Mode != ModeNone {
+		return errors.New("deleted blobs are only supported for plain output, not audit or matching mode")
+	}
+
+	if c.WriteState && c.Mode != ModeNone {
+		return errors.New("state files and incremental runs are only supported for plain output, not audit or matching mode")
+	}
+
+	switch c.Mode {
+	case ModeNone:
+		if len(c.KnownFiles) > 0 {
+			return errors.New("known hashes require one of audit, match or negative match mode")
+		}
+	case ModeAudit, ModeMatch, ModeNegativeMatch:
+		if len(c.KnownFiles) == 0 {
+			return fmt.Errorf("%s mode requires at least one file of known hashes", c.Mode)
+		}
+	default:
+		return fmt.Errorf("unknown mode '%s'", c.Mode)
+	}
+
+	return nil
+}
+
+// Validates every source, which must not overlap
+func (c *GenerateConfig) validateSources() error {
+	if c.Container != "" || c.AllContainers || c.Directory != "" {
+		return errors.New("containers and directories cannot be specified along with sources")
+	}
+
+	for i := range c.Sources {
+		s := &c.Sources[i]
+		if s.AllContainers {
+			return errors.New("a source must be a single container")
+		}
+		if err := s.Validate(); err != nil {
+			return fmt.Errorf("source %s: %w", s.sourceName(), err)
+		}
+		c.IncludeDeleted = c.IncludeDeleted || s.IncludeDeleted
+
+		for _, other := range c.Sources[:i] {
+			if other.AccountName == s.AccountName && other.Container == s.Container && overlaps(other.listingPrefixes(), s.listingPrefixes()) {
+				return fmt.Errorf("sources %s and %s overlap", other.sourceName(), s.sourceName())
+			}
+		}
+	}
+
+	// The header of the output declares the algorithms of every source
+	for _, s := range c.Sources[1:] {
+		if strings.Join(s.Algorithms, ",") != strings.Join(c.Sources[0].Algorithms, ",") {
+			return errors.New("every source must use the same algorithms")
+		}
+	}
+	c.Algorithms = c.Sources[0].Algorithms
+
+	return nil
+}
+
+func (c *VerifyConfig) Validate() error {
+	if err := c.TraversalConfig.Validate(); err != nil {
+		return err
+	}
+
+	if c.InputFile == "" {
+		return errors.New("input file must be specified")
+	}
+
+	if c.AllContainers {
+		return errors.New("only a single container can be verified")
+	}
+
+	if c.IncludeDeleted {
+		return errors.New("deleted blobs are only listed when generating a manifest")
+	}
+
+	return nil
+}
+
+// Validates the container traversal and derives the traversal of the local
+// directory from it. Both are compared in listing order, so they must list
+// the same paths in the same order.
+func (c *VerifyLocalConfig) Validate() error {
+	if c.LocalDirectory == "" {
+		return errors.New("local directory must be specified")
+	}
+
+	if err := c.TraversalConfig.Validate(); err != nil {
+		return err
+	}
+
+	if c.AllContainers {
+		return errors.New("only a single container can be verified")
+	}
+
+	if c.IncludeVersions || c.IncludeSnapshots || c.IncludeDeleted {
+		return errors.New("versions, snapshots and deleted blobs have no local counterpart")
+	}
+
+	if c.MinSize != "" || c.MaxSize != "" || c.ModifiedAfter != "" || c.ModifiedBefore != "" || len(c.ContentTypes) > 0 || len(c.Tiers) > 0 {
+		return errors.New("property filters are not supported when verifying a local directory, the filtered blobs would be reported as missing")
+	}
+
+	if c.Prefix != "" {
+		return errors.New("a path prefix is not used when verifying a local directory")
+	}
+
+	c.local = TraversalConfig{
+		Directory:       c.LocalDirectory,
+		IncludePrefixes: c.IncludePrefixes,
+		Include:         c.Include,
+		Exclude:         c.Exclude,
+		ExcludeFrom:     c.ExcludeFrom,
+		WorkerCount:     c.WorkerCount,
+		Algorithms:      c.Algorithms,
+	}
+
+	// The local directory corresponds to the stripped prefix
+	if c.StripPrefix {
+		if len(c.Include) > 0 || len(c.Exclude) > 0 || c.ExcludeFrom != "" {
+			return errors.New("include and exclude patterns cannot be combined with stripping the prefix when verifying a local directory")
+		}
+		c.local.IncludePrefixes = nil
+	}
+
+	if err := c.local.Validate(); err != nil {
+		return fmt.Errorf("local directory: %w", err)
+	}
+
+	return nil
+}
+
+func (c *CompareConfig) Validate() error {
+	if c.LeftFile == "" || c.RightFile == "" {
+		return errors.New("two hashdeep files must be specified")
+	}
+
+	if c.ChunkSize < 1 {
+		return errors.New("sort chunk size must be positive")
+	}
 
 	return nil
 }
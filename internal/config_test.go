@@ -0,0 +1,57 @@
+/*
+Copyright © 2019 Even Holthe
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package internal
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGenerateConfigOutputDate(t *testing.T) {
+	dir := t.TempDir()
+	today := time.Now().Format("2006-01-02")
+
+	tests := []struct {
+		name    string
+		output  string
+		resume  bool
+		want    string
+		wantErr string
+	}{
+		{name: "date", output: dir + "/out-{date}.hashdeep", want: dir + "/out-" + today + ".hashdeep"},
+		{name: "resume", output: dir + "/out-2024-01-31.hashdeep", resume: true, want: dir + "/out-2024-01-31.hashdeep"},
+		{name: "resume with date", output: dir + "/out-{date}.hashdeep", resume: true, wantErr: "{date} cannot be used in the output path of a resumed run"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c, err := NewGenerateConfig(TraversalConfig{Directory: dir, Algorithms: []string{"md5"}}, nil, test.output, test.resume, false, "", nil, ModeNone, 0)
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("NewGenerateConfig() error = %v, want %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if c.OutputFile != test.want {
+				t.Errorf("OutputFile = %s, want %s", c.OutputFile, test.want)
+			}
+		})
+	}
+}
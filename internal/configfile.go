@@ -0,0 +1,238 @@
+/*
+Copyright © 2019 Even Holthe
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package internal
+
+import (
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+)
+
+// FileSettings are the settings of a config file. They can be given at the
+// top level as defaults and for each container. Keys are named after the
+// command line flags. Secrets can only be referenced by file.
+type FileSettings struct {
+	AccountName        string   `yaml:"account-name"`
+	Container          string   `yaml:"container"`
+	AllContainers      *bool    `yaml:"all-containers"`
+	IncludeContainers  []string `yaml:"include-container"`
+	ExcludeContainers  []string `yaml:"exclude-container"`
+	Auth               string   `yaml:"auth"`
+	AccountKeyFile     string   `yaml:"account-key-file"`
+	SasTokenFile       string   `yaml:"sas-token-file"`
+	TenantID           string   `yaml:"tenant-id"`
+	ClientID           string   `yaml:"client-id"`
+	ClientCertificate  string   `yaml:"client-certificate"`
+	FederatedTokenFile string   `yaml:"federated-token-file"`
+	Cloud              string   `yaml:"cloud"`
+	Endpoint           string   `yaml:"endpoint"`
+	PathStyle          *bool    `yaml:"path-style"`
+	Prefix             string   `yaml:"prefix"`
+	IncludePrefixes    []string `yaml:"include-prefix"`
+	StripPrefix        *bool    `yaml:"strip-prefix"`
+	Include            []string `yaml:"include"`
+	Exclude            []string `yaml:"exclude"`
+	ExcludeFrom        string   `yaml:"exclude-from"`
+	MinSize            string   `yaml:"min-size"`
+	MaxSize            string   `yaml:"max-size"`
+	ModifiedAfter      string   `yaml:"modified-after"`
+	ModifiedBefore     string   `yaml:"modified-before"`
+	ContentTypes       []string `yaml:"content-type"`
+	Tiers              []string `yaml:"tier"`
+	IncludeVersions    *bool    `yaml:"include-versions"`
+	IncludeSnapshots   *bool    `yaml:"include-snapshots"`
+	IncludeDeleted     *bool    `yaml:"include-deleted"`
+	Calculate          *bool    `yaml:"calculate"`
+	Archive            string   `yaml:"archive"`
+	RehydrateTier      string   `yaml:"rehydrate-tier"`
+	RehydratePriority  string   `yaml:"rehydrate-priority"`
+	// A duration such as 15h
+	RehydrateWait time.Duration `yaml:"rehydrate-wait"`
+	Cache         string        `yaml:"cache"`
+	Algorithms    []string      `yaml:"algorithms"`
+	Workers       int           `yaml:"workers"`
+	// Output path, see expandOutputPath for the supported placeholders
+	Output string `yaml:"output"`
+}
+
+// ConfigFile describes one or more containers to process in a single run,
+// either each into its own output or as sources combined into one output.
+type ConfigFile struct {
+	FileSettings `yaml:",inline"`
+	Containers   []FileSettings `yaml:"containers"`
+	Sources      []FileSettings `yaml:"sources"`
+}
+
+// LoadConfigFile reads a YAML config file, rejecting unknown keys.
+func LoadConfigFile(path string) (*ConfigFile, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	config := &ConfigFile{}
+	decoder := yaml.NewDecoder(file)
+	decoder.KnownFields(true)
+	if err := decoder.Decode(config); err != nil {
+		return nil, errors.Wrapf(err, "could not parse config file '%s'", path)
+	}
+
+	if len(config.Containers) > 0 && len(config.Sources) > 0 {
+		return nil, errors.Errorf("config file '%s' cannot list both containers and sources", path)
+	}
+
+	return config, nil
+}
+
+// Jobs returns the settings of every container with the top level settings
+// applied as defaults. Without a container list the top level settings
+// describe a single container.
+func (f *ConfigFile) Jobs() []FileSettings {
+	if len(f.Containers) == 0 {
+		return []FileSettings{f.FileSettings}
+	}
+
+	jobs := make([]FileSettings, 0, len(f.Containers))
+	for _, container := range f.Containers {
+		job := f.FileSettings
+		job.override(&container)
+		jobs = append(jobs, job)
+	}
+
+	return jobs
+}
+
+// SourceSettings returns the settings of every source with the top level
+// settings applied as defaults. The top level prefix applies to the combined
+// output, so the prefix of a source is only its own.
+func (f *ConfigFile) SourceSettings() []FileSettings {
+	sources := make([]FileSettings, 0, len(f.Sources))
+	for _, source := range f.Sources {
+		settings := f.FileSettings
+		settings.override(&source)
+		settings.Prefix = source.Prefix
+		sources = append(sources, settings)
+	}
+
+	return sources
+}
+
+// Replaces every setting that is set in o
+func (s *FileSettings) override(o *FileSettings) {
+	setIfNotEmpty := func(target *string, value string) {
+		if value != "" {
+			*target = value
+		}
+	}
+
+	setIfNotEmpty(&s.AccountName, o.AccountName)
+	setIfNotEmpty(&s.Container, o.Container)
+	setIfNotEmpty(&s.Auth, o.Auth)
+	setIfNotEmpty(&s.TenantID, o.TenantID)
+	setIfNotEmpty(&s.ClientID, o.ClientID)
+	setIfNotEmpty(&s.ClientCertificate, o.ClientCertificate)
+	setIfNotEmpty(&s.FederatedTokenFile, o.FederatedTokenFile)
+	setIfNotEmpty(&s.Cloud, o.Cloud)
+	setIfNotEmpty(&s.Endpoint, o.Endpoint)
+	setIfNotEmpty(&s.Prefix, o.Prefix)
+	setIfNotEmpty(&s.Cache, o.Cache)
+	setIfNotEmpty(&s.Archive, o.Archive)
+	setIfNotEmpty(&s.RehydrateTier, o.RehydrateTier)
+	setIfNotEmpty(&s.RehydratePriority, o.RehydratePriority)
+	setIfNotEmpty(&s.ExcludeFrom, o.ExcludeFrom)
+	setIfNotEmpty(&s.MinSize, o.MinSize)
+	setIfNotEmpty(&s.MaxSize, o.MaxSize)
+	setIfNotEmpty(&s.ModifiedAfter, o.ModifiedAfter)
+	setIfNotEmpty(&s.ModifiedBefore, o.ModifiedBefore)
+	setIfNotEmpty(&s.Output, o.Output)
+
+	// An account key or SAS token replaces both, so credentials of different kinds are never combined
+	if o.AccountKeyFile != "" || o.SasTokenFile != "" {
+		s.AccountKeyFile = o.AccountKeyFile
+		s.SasTokenFile = o.SasTokenFile
+	}
+
+	if o.AllContainers != nil {
+		s.AllContainers = o.AllContainers
+	}
+	if len(o.IncludeContainers) > 0 {
+		s.IncludeContainers = o.IncludeContainers
+	}
+	if len(o.ExcludeContainers) > 0 {
+		s.ExcludeContainers = o.ExcludeContainers
+	}
+	if o.PathStyle != nil {
+		s.PathStyle = o.PathStyle
+	}
+	if len(o.IncludePrefixes) > 0 {
+		s.IncludePrefixes = o.IncludePrefixes
+	}
+	if len(o.Include) > 0 {
+		s.Include = o.Include
+	}
+	if len(o.Exclude) > 0 {
+		s.Exclude = o.Exclude
+	}
+	if len(o.ContentTypes) > 0 {
+		s.ContentTypes = o.ContentTypes
+	}
+	if len(o.Tiers) > 0 {
+		s.Tiers = o.Tiers
+	}
+	if o.IncludeVersions != nil {
+		s.IncludeVersions = o.IncludeVersions
+	}
+	if o.IncludeSnapshots != nil {
+		s.IncludeSnapshots = o.IncludeSnapshots
+	}
+	if o.IncludeDeleted != nil {
+		s.IncludeDeleted = o.IncludeDeleted
+	}
+	if o.StripPrefix != nil {
+		s.StripPrefix = o.StripPrefix
+	}
+	if o.Calculate != nil {
+		s.Calculate = o.Calculate
+	}
+	if len(o.Algorithms) > 0 {
+		s.Algorithms = o.Algorithms
+	}
+	if o.RehydrateWait > 0 {
+		s.RehydrateWait = o.RehydrateWait
+	}
+	if o.Workers > 0 {
+		s.Workers = o.Workers
+	}
+}
+
+// Expands {account}, {container} and {date} (YYYY-MM-DD) in an output path.
+// {container} is kept when traversing all containers, see generateAccount.
+func expandOutputPath(path string, c *TraversalConfig) string {
+	container := c.Container
+	if c.AllContainers {
+		container = containerPlaceholder
+	}
+
+	return strings.NewReplacer(
+		"{account}", c.AccountName,
+		containerPlaceholder, container,
+		"{date}", time.Now().Format("2006-01-02"),
+	).Replace(path)
+}
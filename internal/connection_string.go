@@ -0,0 +1,138 @@
+/*
+Copyright © 2019 Even Holthe
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package internal
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Well-known credentials of the Azure Storage emulators, used by UseDevelopmentStorage=true
+const (
+	developmentAccountName = "devstoreaccount1"
+	developmentAccountKey  = "Eby8vdM02xNOcqFlqUwJPLlmEtlCDXJ1OUzFT50uSRZ6IFsuFq2UVErCz4I6tq/K1SZFPTOtr/KBHBeksoGMGw=="
+	developmentEndpoint    = "http://127.0.0.1:10000/" + developmentAccountName
+)
+
+// Fills the account, credential and endpoint fields from an Azure Storage
+// connection string, e.g. "DefaultEndpointsProtocol=https;AccountName=...;AccountKey=...".
+// Fields that are already set take precedence over the connection string.
+func applyConnectionString(c *TraversalConfig) error {
+	if c.ConnectionString == "" {
+		return nil
+	}
+
+	values, err := parseConnectionString(c.ConnectionString)
+	if err != nil {
+		return err
+	}
+
+	if strings.EqualFold(values["usedevelopmentstorage"], "true") {
+		values["accountname"] = developmentAccountName
+		values["accountkey"] = developmentAccountKey
+		values["blobendpoint"] = developmentEndpoint
+	}
+
+	endpoint := values["blobendpoint"]
+	if endpoint == "" && values["accountname"] != "" {
+		protocol := values["defaultendpointsprotocol"]
+		suffix := values["endpointsuffix"]
+
+		// Only override the default endpoint when the connection string deviates from it
+		if (protocol != "" && protocol != "https") || (suffix != "" && suffix != "core.windows.net") {
+			if protocol == "" {
+				protocol = "https"
+			}
+			if suffix == "" {
+				suffix = "core.windows.net"
+			}
+			endpoint = fmt.Sprintf("%s://%s.blob.%s", protocol, values["accountname"], suffix)
+		}
+	}
+
+	accountName := values["accountname"]
+	if accountName == "" && endpoint != "" {
+		accountName = accountNameFromEndpoint(endpoint)
+	}
+
+	// The key, SAS token and endpoint belong to the connection string's account
+	if c.AccountName != "" && accountName != "" && !strings.EqualFold(c.AccountName, accountName) {
+		return errors.Errorf("account name '%s' does not match the connection string's account '%s'", c.AccountName, accountName)
+	}
+
+	setIfEmpty(&c.AccountName, accountName)
+	setIfEmpty(&c.Endpoint, endpoint)
+	if c.AccountKey == "" && c.SasToken == "" {
+		c.AccountKey = values["accountkey"]
+		c.SasToken = values["sharedaccesssignature"]
+	}
+
+	if c.AccountKey == "" && c.SasToken == "" && c.Auth == "" {
+		return errors.New("connection string contains neither AccountKey nor SharedAccessSignature")
+	}
+
+	return nil
+}
+
+func parseConnectionString(connectionString string) (map[string]string, error) {
+	values := make(map[string]string)
+
+	for _, part := range strings.Split(connectionString, ";") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		// Values such as account keys and SAS tokens may contain '='
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, errors.New("malformed connection string, expected key=value pairs separated by semicolons")
+		}
+		values[strings.ToLower(strings.TrimSpace(kv[0]))] = strings.TrimSpace(kv[1])
+	}
+
+	if len(values) == 0 {
+		return nil, errors.New("connection string is empty")
+	}
+
+	return values, nil
+}
+
+// Derives the account name from either a path-style or a virtual-host style endpoint
+func accountNameFromEndpoint(endpoint string) string {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return ""
+	}
+
+	if path := strings.Trim(u.Path, "/"); path != "" {
+		return strings.SplitN(path, "/", 2)[0]
+	}
+	if isPathStyleHost(u.Hostname()) {
+		return ""
+	}
+
+	return strings.SplitN(u.Hostname(), ".", 2)[0]
+}
+
+func setIfEmpty(field *string, value string) {
+	if *field == "" {
+		*field = value
+	}
+}
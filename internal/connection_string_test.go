@@ -0,0 +1,128 @@
+/*
+Copyright © 2019 Even Holthe
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package internal
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestApplyConnectionString(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  TraversalConfig
+		want    TraversalConfig
+		wantErr string
+	}{
+		{
+			name:   "account key",
+			config: TraversalConfig{ConnectionString: "DefaultEndpointsProtocol=https;AccountName=acc;AccountKey=a2V5==;EndpointSuffix=core.windows.net"},
+			want:   TraversalConfig{AccountName: "acc", AccountKey: "a2V5=="},
+		},
+		{
+			name:   "development storage",
+			config: TraversalConfig{ConnectionString: "UseDevelopmentStorage=true"},
+			want:   TraversalConfig{AccountName: developmentAccountName, AccountKey: developmentAccountKey, Endpoint: developmentEndpoint},
+		},
+		{
+			name:   "endpoint suffix",
+			config: TraversalConfig{ConnectionString: "AccountName=acc;AccountKey=key;EndpointSuffix=core.chinacloudapi.cn"},
+			want:   TraversalConfig{AccountName: "acc", AccountKey: "key", Endpoint: "https://acc.blob.core.chinacloudapi.cn"},
+		},
+		{
+			name:   "http protocol",
+			config: TraversalConfig{ConnectionString: "DefaultEndpointsProtocol=http;AccountName=acc;AccountKey=key"},
+			want:   TraversalConfig{AccountName: "acc", AccountKey: "key", Endpoint: "http://acc.blob.core.windows.net"},
+		},
+		{
+			name:   "blob endpoint",
+			config: TraversalConfig{ConnectionString: "BlobEndpoint=https://acc.blob.example.com/;SharedAccessSignature=sv=2021&sig=abc="},
+			want:   TraversalConfig{AccountName: "acc", SasToken: "sv=2021&sig=abc=", Endpoint: "https://acc.blob.example.com/"},
+		},
+		{
+			name:   "path-style blob endpoint",
+			config: TraversalConfig{ConnectionString: "BlobEndpoint=http://127.0.0.1:10000/acc;AccountKey=key"},
+			want:   TraversalConfig{AccountName: "acc", AccountKey: "key", Endpoint: "http://127.0.0.1:10000/acc"},
+		},
+		{
+			name:   "blob endpoint wins over suffix",
+			config: TraversalConfig{ConnectionString: "AccountName=acc;AccountKey=key;EndpointSuffix=core.chinacloudapi.cn;BlobEndpoint=https://acc.blob.example.com"},
+			want:   TraversalConfig{AccountName: "acc", AccountKey: "key", Endpoint: "https://acc.blob.example.com"},
+		},
+		{
+			name:   "set fields win",
+			config: TraversalConfig{ConnectionString: "AccountName=acc;AccountKey=key", AccountName: "ACC", SasToken: "sig=x"},
+			want:   TraversalConfig{AccountName: "ACC", SasToken: "sig=x"},
+		},
+		{
+			name:   "entra id",
+			config: TraversalConfig{ConnectionString: "AccountName=acc", Auth: AuthWorkloadIdentity},
+			want:   TraversalConfig{AccountName: "acc", Auth: AuthWorkloadIdentity},
+		},
+		{
+			name:    "account mismatch",
+			config:  TraversalConfig{ConnectionString: "AccountName=acc;AccountKey=key", AccountName: "other"},
+			wantErr: "account name 'other' does not match the connection string's account 'acc'",
+		},
+		{
+			name:    "account mismatch with blob endpoint",
+			config:  TraversalConfig{ConnectionString: "BlobEndpoint=https://acc.blob.example.com;AccountKey=key", AccountName: "other"},
+			wantErr: "does not match the connection string's account 'acc'",
+		},
+		{
+			name:    "no credential",
+			config:  TraversalConfig{ConnectionString: "AccountName=acc"},
+			wantErr: "neither AccountKey nor SharedAccessSignature",
+		},
+		{
+			name:    "malformed",
+			config:  TraversalConfig{ConnectionString: "AccountName=acc;AccountKey"},
+			wantErr: "malformed connection string",
+		},
+		{
+			name:    "empty",
+			config:  TraversalConfig{ConnectionString: " ; "},
+			wantErr: "connection string is empty",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := applyConnectionString(&test.config)
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("applyConnectionString() error = %v, want %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got := test.config
+			for _, field := range []struct{ name, got, want string }{
+				{"AccountName", got.AccountName, test.want.AccountName},
+				{"AccountKey", got.AccountKey, test.want.AccountKey},
+				{"SasToken", got.SasToken, test.want.SasToken},
+				{"Endpoint", got.Endpoint, test.want.Endpoint},
+			} {
+				if field.got != field.want {
+					t.Errorf("%s = %q, want %q", field.name, field.got, field.want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,135 @@
+/*
+Copyright © 2019 Even Holthe
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package internal
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob"
+	"github.com/openlyinc/pointy"
+	log "github.com/sirupsen/logrus"
+)
+
+// Output paths containing this are written once per container in account-wide mode
+const containerPlaceholder = "{container}"
+
+// Writes the output for every container of the account matching the
+// container filter. With {container} in the output path every container gets
+// its own output, otherwise a combined output is written where the paths
+// start with the container name.
+func generateAccount(ctx context.Context, c *GenerateConfig) bool {
+	logger := log.WithField("phase", "list_containers")
+
+	names, err := listContainers(ctx, &c.TraversalConfig)
+	if err != nil {
+		handleErrors("list_containers", err)(logger)
+		os.Exit(1)
+	}
+	if len(names) == 0 {
+		logger.Warnf("no containers in storage account '%s' to traverse", c.AccountName)
+	}
+	logger.Infof("traversing %d containers in storage account '%s'", len(names), c.AccountName)
+
+	if !strings.Contains(c.OutputFile, containerPlaceholder) {
+		sources := make([]*source, 0, len(names))
+		for _, name := range names {
+			sources = append(sources, &source{config: c.forContainer(name), key: name + "/", pathPrefix: name + "/"})
+		}
+		// Keys, not names, determine the listing order, see checkpoint
+		sort.Slice(sources, func(i, j int) bool { return sources[i].key < sources[j].key })
+
+		return generate(ctx, c, sources, true, fmt.Sprintf("%d containers", len(sources)))
+	}
+
+	succeeded := true
+	for _, name := range names {
+		job := *c
+		job.TraversalConfig = *c.forContainer(name)
+		job.OutputFile = expandOutputPath(c.OutputFile, &job.TraversalConfig)
+		if c.PreviousManifest != "" {
+			job.PreviousManifest = expandOutputPath(c.PreviousManifest, &job.TraversalConfig)
+		}
+
+		if job.Resume {
+			resume, done := resumeState(job.OutputFile)
+			if done {
+				logger.Infof("skipping container '%s', %s is complete", name, job.OutputFile)
+				continue
+			}
+			job.Resume = resume
+		}
+
+		if !generate(ctx, &job, []*source{{config: &job.TraversalConfig}}, false, fmt.Sprintf("container '%s'", name)) {
+			succeeded = false
+		}
+		if ctx.Err() != nil {
+			return false
+		}
+	}
+
+	return succeeded
+}
+
+// Reports whether the output of a container can be resumed, or whether it
+// was completed by the interrupted run. Neither is the case when the
+// interrupted run did not get to it.
+func resumeState(output string) (resume bool, done bool) {
+	if _, err := os.Stat(output + checkpointSuffix); err == nil {
+		return true, false
+	}
+	if _, err := os.Stat(output); err == nil {
+		return false, true
+	}
+
+	return false, false
+}
+
+// Returns a copy of the config traversing a single container
+func (c *TraversalConfig) forContainer(name string) *TraversalConfig {
+	config := *c
+	config.AllContainers = false
+	config.Container = name
+
+	return &config
+}
+
+// Lists the names of the containers in the account that match the container filter
+func listContainers(ctx context.Context, c *TraversalConfig) ([]string, error) {
+	service, err := configureServiceClient(c)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	pager := service.ListContainers(&azblob.ListContainersOptions{MaxResults: pointy.Int32(maxAzResults)})
+	for pager.NextPage(ctx) {
+		for _, item := range pager.PageResponse().ContainerItems {
+			if item == nil || item.Name == nil {
+				continue
+			}
+			if !c.containers.matchesName(*item.Name) {
+				continue
+			}
+			names = append(names, *item.Name)
+		}
+	}
+
+	return names, pager.Err()
+}
@@ -0,0 +1,112 @@
+/*
+Copyright © 2019 Even Holthe
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package internal
+
+import (
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// Environment variables used when no other source provides the account or its credentials
+const (
+	envAccountName      = "AZURE_STORAGE_ACCOUNT"
+	envAccountKey       = "AZURE_STORAGE_KEY"
+	envSasToken         = "AZURE_STORAGE_SAS_TOKEN"
+	envConnectionString = "AZURE_STORAGE_CONNECTION_STRING"
+)
+
+// Path that reads a credential from stdin instead of a file
+const stdinPath = "-"
+
+// Stdin can only be consumed once, but is needed for every container in a config file
+var (
+	stdinOnce sync.Once
+	stdinData []byte
+	stdinErr  error
+)
+
+// Resolves the account name, key and SAS token according to the precedence
+// documented on TraversalConfig.
+func resolveCredentials(c *TraversalConfig) error {
+	if c.AccountKey != "" && c.AccountKeyFile != "" {
+		return errors.New("account key and account key file are mutually exclusive")
+	}
+	if c.SasToken != "" && c.SasTokenFile != "" {
+		return errors.New("SAS token and SAS token file are mutually exclusive")
+	}
+	if c.AccountKeyFile == stdinPath && c.SasTokenFile == stdinPath {
+		return errors.New("only one credential can be read from stdin")
+	}
+
+	var err error
+	if c.AccountKeyFile != "" {
+		if c.AccountKey, err = readCredential(c.AccountKeyFile); err != nil {
+			return errors.Wrap(err, "could not read account key")
+		}
+	}
+	if c.SasTokenFile != "" {
+		if c.SasToken, err = readCredential(c.SasTokenFile); err != nil {
+			return errors.Wrap(err, "could not read SAS token")
+		}
+	}
+
+	setIfEmpty(&c.ConnectionString, os.Getenv(envConnectionString))
+	if err := applyConnectionString(c); err != nil {
+		return err
+	}
+
+	setIfEmpty(&c.AccountName, os.Getenv(envAccountName))
+	if c.AccountKey == "" && c.SasToken == "" {
+		c.AccountKey = os.Getenv(envAccountKey)
+		c.SasToken = os.Getenv(envSasToken)
+		if c.AccountKey != "" && c.SasToken != "" {
+			return errors.Errorf("both %s and %s are set in the environment, unset one of them", envAccountKey, envSasToken)
+		}
+	}
+
+	return nil
+}
+
+// Reads a credential from a file (e.g. a mounted Kubernetes secret) or stdin, ignoring surrounding whitespace
+func readCredential(path string) (string, error) {
+	var (
+		data []byte
+		err  error
+	)
+
+	if path == stdinPath {
+		stdinOnce.Do(func() {
+			stdinData, stdinErr = io.ReadAll(os.Stdin)
+		})
+		data, err = stdinData, stdinErr
+	} else {
+		data, err = os.ReadFile(path)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	credential := strings.TrimSpace(string(data))
+	if credential == "" {
+		return "", errors.Errorf("'%s' is empty", path)
+	}
+
+	return credential, nil
+}
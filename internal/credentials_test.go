@@ -0,0 +1,191 @@
+/*
+Copyright © 2019 Even Holthe
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// Replaces stdin with the given content and forgets what was read from it before
+func fakeStdin(t *testing.T, content string) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.WriteString(content); err != nil {
+		t.Fatal(err)
+	}
+	_ = w.Close()
+
+	stdin := os.Stdin
+	os.Stdin = r
+	stdinOnce, stdinData, stdinErr = sync.Once{}, nil, nil
+	t.Cleanup(func() {
+		os.Stdin = stdin
+		_ = r.Close()
+	})
+}
+
+func TestResolveCredentials(t *testing.T) {
+	dir := t.TempDir()
+	keyFile := filepath.Join(dir, "key")
+	sasFile := filepath.Join(dir, "sas")
+	emptyFile := filepath.Join(dir, "empty")
+	for path, content := range map[string]string{keyFile: "file-key\n", sasFile: " sig=file\n", emptyFile: "\n"} {
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name    string
+		config  TraversalConfig
+		env     map[string]string
+		stdin   string
+		want    TraversalConfig
+		wantErr string
+	}{
+		{
+			name:   "flag",
+			config: TraversalConfig{AccountName: "acc", AccountKey: "flag-key"},
+			env:    map[string]string{envAccountName: "env", envAccountKey: "env-key", envConnectionString: "AccountName=acc;AccountKey=cs-key"},
+			want:   TraversalConfig{AccountName: "acc", AccountKey: "flag-key"},
+		},
+		{
+			name:   "file",
+			config: TraversalConfig{AccountName: "acc", AccountKeyFile: keyFile},
+			env:    map[string]string{envAccountKey: "env-key", envConnectionString: "AccountName=acc;AccountKey=cs-key"},
+			want:   TraversalConfig{AccountName: "acc", AccountKey: "file-key"},
+		},
+		{
+			name:   "sas token file",
+			config: TraversalConfig{AccountName: "acc", SasTokenFile: sasFile},
+			want:   TraversalConfig{AccountName: "acc", SasToken: "sig=file"},
+		},
+		{
+			name:   "stdin",
+			config: TraversalConfig{AccountName: "acc", SasTokenFile: stdinPath},
+			env:    map[string]string{envSasToken: "sig=env"},
+			stdin:  "sig=stdin\n",
+			want:   TraversalConfig{AccountName: "acc", SasToken: "sig=stdin"},
+		},
+		{
+			name:   "connection string from the environment",
+			config: TraversalConfig{},
+			env:    map[string]string{envAccountName: "env", envAccountKey: "env-key", envConnectionString: "AccountName=acc;AccountKey=cs-key"},
+			want:   TraversalConfig{AccountName: "acc", AccountKey: "cs-key"},
+		},
+		{
+			name:   "connection string flag wins over the environment",
+			config: TraversalConfig{ConnectionString: "AccountName=acc;AccountKey=flag-key"},
+			env:    map[string]string{envConnectionString: "AccountName=acc;AccountKey=env-key"},
+			want:   TraversalConfig{AccountName: "acc", AccountKey: "flag-key"},
+		},
+		{
+			name:   "environment",
+			config: TraversalConfig{},
+			env:    map[string]string{envAccountName: "env", envSasToken: "sig=env"},
+			want:   TraversalConfig{AccountName: "env", SasToken: "sig=env"},
+		},
+		{
+			name:   "account flag wins over the environment",
+			config: TraversalConfig{AccountName: "acc"},
+			env:    map[string]string{envAccountName: "env", envAccountKey: "env-key"},
+			want:   TraversalConfig{AccountName: "acc", AccountKey: "env-key"},
+		},
+		{
+			name:    "key and key file",
+			config:  TraversalConfig{AccountKey: "flag-key", AccountKeyFile: keyFile},
+			wantErr: "account key and account key file are mutually exclusive",
+		},
+		{
+			name:    "token and token file",
+			config:  TraversalConfig{SasToken: "sig=flag", SasTokenFile: sasFile},
+			wantErr: "SAS token and SAS token file are mutually exclusive",
+		},
+		{
+			name:    "both from stdin",
+			config:  TraversalConfig{AccountKeyFile: stdinPath, SasTokenFile: stdinPath},
+			wantErr: "only one credential can be read from stdin",
+		},
+		{
+			name:    "empty file",
+			config:  TraversalConfig{AccountKeyFile: emptyFile},
+			wantErr: "is empty",
+		},
+		{
+			name:    "missing file",
+			config:  TraversalConfig{AccountKeyFile: filepath.Join(dir, "missing")},
+			wantErr: "could not read account key",
+		},
+		{
+			name:    "key and token in the environment",
+			config:  TraversalConfig{AccountName: "acc"},
+			env:     map[string]string{envAccountKey: "env-key", envSasToken: "sig=env"},
+			wantErr: "both AZURE_STORAGE_KEY and AZURE_STORAGE_SAS_TOKEN are set",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for _, name := range []string{envAccountName, envAccountKey, envSasToken, envConnectionString} {
+				t.Setenv(name, test.env[name])
+			}
+			fakeStdin(t, test.stdin)
+
+			err := resolveCredentials(&test.config)
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("resolveCredentials() error = %v, want %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got := test.config
+			for _, field := range []struct{ name, got, want string }{
+				{"AccountName", got.AccountName, test.want.AccountName},
+				{"AccountKey", got.AccountKey, test.want.AccountKey},
+				{"SasToken", got.SasToken, test.want.SasToken},
+			} {
+				if field.got != field.want {
+					t.Errorf("%s = %q, want %q", field.name, field.got, field.want)
+				}
+			}
+		})
+	}
+}
+
+func TestResolveCredentialsReadsStdinOnce(t *testing.T) {
+	fakeStdin(t, "stdin-key\n")
+
+	// Every container of a config file resolves its credentials separately
+	for _, container := range []string{"first", "second"} {
+		c := TraversalConfig{AccountName: "acc", Container: container, AccountKeyFile: stdinPath}
+		if err := resolveCredentials(&c); err != nil {
+			t.Fatal(err)
+		}
+		if c.AccountKey != "stdin-key" {
+			t.Errorf("%s: AccountKey = %q, want stdin-key", container, c.AccountKey)
+		}
+	}
+}
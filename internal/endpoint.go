@@ -0,0 +1,107 @@
+/*
+Copyright © 2019 Even Holthe
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package internal
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const CloudPublic = "public"
+
+// Blob service DNS suffixes of the Azure clouds
+var cloudSuffixes = map[string]string{
+	CloudPublic: "blob.core.windows.net",
+	"china":     "blob.core.chinacloudapi.cn",
+	"usgov":     "blob.core.usgovcloudapi.net",
+}
+
+func cloudNames() []string {
+	names := make([]string, 0, len(cloudSuffixes))
+	for name := range cloudSuffixes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+func validateEndpoint(c *TraversalConfig) error {
+	if c.Cloud != "" && c.Endpoint != "" {
+		return errors.New("cloud and endpoint are mutually exclusive")
+	}
+
+	if c.PathStyle && c.Endpoint == "" {
+		return errors.New("path-style requires a custom endpoint")
+	}
+
+	if _, ok := cloudSuffixes[c.Cloud]; c.Cloud != "" && !ok {
+		return errors.Errorf("unknown cloud '%s', must be one of %s", c.Cloud, strings.Join(cloudNames(), ", "))
+	}
+
+	if c.Endpoint != "" {
+		u, err := url.Parse(c.Endpoint)
+		if err != nil {
+			return errors.Wrap(err, "invalid endpoint")
+		}
+		if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return errors.Errorf("endpoint must be an absolute http(s) URL, got '%s'", c.Endpoint)
+		}
+		if u.RawQuery != "" {
+			return errors.New("endpoint must not contain a query, pass SAS tokens separately")
+		}
+	}
+
+	return nil
+}
+
+// Returns the URL of the blob service, without a trailing slash.
+//
+// Custom endpoints are used as is (virtual-host style), unless path-style is
+// requested or the host is an IP address or localhost (as with Azurite), in
+// which case the account name is appended to the endpoint path.
+func (c *TraversalConfig) serviceURL() string {
+	if c.Endpoint == "" {
+		cloud := c.Cloud
+		if cloud == "" {
+			cloud = CloudPublic
+		}
+
+		return fmt.Sprintf("https://%s.%s", c.AccountName, cloudSuffixes[cloud])
+	}
+
+	u, _ := url.Parse(c.Endpoint)
+	u.Path = strings.TrimSuffix(u.Path, "/")
+
+	if u.Path == "" && (c.PathStyle || isPathStyleHost(u.Hostname())) {
+		u.Path = "/" + c.AccountName
+	}
+
+	return u.String()
+}
+
+func (c *TraversalConfig) containerURL() string {
+	return c.serviceURL() + "/" + url.PathEscape(c.Container)
+}
+
+func isPathStyleHost(host string) bool {
+	return host == "localhost" || net.ParseIP(host) != nil
+}
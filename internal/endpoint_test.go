@@ -0,0 +1,90 @@
+/*
+Copyright © 2019 Even Holthe
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package internal
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestServiceURL(t *testing.T) {
+	tests := []struct {
+		name   string
+		config TraversalConfig
+		want   string
+	}{
+		{name: "public cloud", config: TraversalConfig{AccountName: "acc"}, want: "https://acc.blob.core.windows.net"},
+		{name: "explicit public cloud", config: TraversalConfig{AccountName: "acc", Cloud: "public"}, want: "https://acc.blob.core.windows.net"},
+		{name: "china", config: TraversalConfig{AccountName: "acc", Cloud: "china"}, want: "https://acc.blob.core.chinacloudapi.cn"},
+		{name: "usgov", config: TraversalConfig{AccountName: "acc", Cloud: "usgov"}, want: "https://acc.blob.core.usgovcloudapi.net"},
+		{name: "custom endpoint", config: TraversalConfig{AccountName: "acc", Endpoint: "https://acc.privatelink.blob.core.windows.net/"}, want: "https://acc.privatelink.blob.core.windows.net"},
+		{name: "ip address", config: TraversalConfig{AccountName: "devstoreaccount1", Endpoint: "http://127.0.0.1:10000"}, want: "http://127.0.0.1:10000/devstoreaccount1"},
+		{name: "ipv6 address", config: TraversalConfig{AccountName: "acc", Endpoint: "http://[::1]:10000/"}, want: "http://[::1]:10000/acc"},
+		{name: "localhost", config: TraversalConfig{AccountName: "acc", Endpoint: "http://localhost:10000"}, want: "http://localhost:10000/acc"},
+		{name: "path already given", config: TraversalConfig{AccountName: "acc", Endpoint: "http://127.0.0.1:10000/other"}, want: "http://127.0.0.1:10000/other"},
+		{name: "forced path-style", config: TraversalConfig{AccountName: "acc", Endpoint: "https://storage.example.com", PathStyle: true}, want: "https://storage.example.com/acc"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := test.config.serviceURL(); got != test.want {
+				t.Errorf("serviceURL() = %s, want %s", got, test.want)
+			}
+		})
+	}
+}
+
+func TestContainerURL(t *testing.T) {
+	c := TraversalConfig{AccountName: "acc", Container: "my container"}
+	if got, want := c.containerURL(), "https://acc.blob.core.windows.net/my%20container"; got != want {
+		t.Errorf("containerURL() = %s, want %s", got, want)
+	}
+}
+
+func TestValidateEndpoint(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  TraversalConfig
+		wantErr string
+	}{
+		{name: "default", config: TraversalConfig{}},
+		{name: "cloud", config: TraversalConfig{Cloud: "china"}},
+		{name: "endpoint", config: TraversalConfig{Endpoint: "http://127.0.0.1:10000"}},
+		{name: "path-style endpoint", config: TraversalConfig{Endpoint: "https://storage.example.com", PathStyle: true}},
+		{name: "cloud and endpoint", config: TraversalConfig{Cloud: "china", Endpoint: "https://x"}, wantErr: "mutually exclusive"},
+		{name: "path-style without endpoint", config: TraversalConfig{PathStyle: true}, wantErr: "path-style requires a custom endpoint"},
+		{name: "retired cloud", config: TraversalConfig{Cloud: "germany"}, wantErr: "unknown cloud 'germany', must be one of china, public, usgov"},
+		{name: "relative endpoint", config: TraversalConfig{Endpoint: "storage.example.com"}, wantErr: "absolute http(s) URL"},
+		{name: "other scheme", config: TraversalConfig{Endpoint: "ftp://storage.example.com"}, wantErr: "absolute http(s) URL"},
+		{name: "query", config: TraversalConfig{Endpoint: "https://storage.example.com?sig=x"}, wantErr: "must not contain a query"},
+		{name: "malformed", config: TraversalConfig{Endpoint: "http://[::1"}, wantErr: "invalid endpoint"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := validateEndpoint(&test.config)
+			if test.wantErr == "" {
+				if err != nil {
+					t.Errorf("validateEndpoint() = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("validateEndpoint() = %v, want %q", err, test.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,255 @@
+/*
+Copyright © 2019 Even Holthe
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package internal
+
+import (
+	"bufio"
+	"container/heap"
+	"encoding/gob"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/evenh/az-blob-hashdeep/internal/hashdeep"
+	"github.com/pkg/errors"
+)
+
+type entryLess func(a, b *hashdeep.Entry) bool
+
+type entryIterator interface {
+	// Next returns the next entry, or io.EOF when exhausted
+	Next() (*hashdeep.Entry, error)
+}
+
+// Sorts an arbitrary number of entries by spilling sorted runs of chunkSize
+// entries to temporary files and merging them when iterating.
+type externalSorter struct {
+	less      entryLess
+	chunkSize int
+	tempDir   string
+	chunk     []*hashdeep.Entry
+	runs      []string
+}
+
+func newExternalSorter(less entryLess, chunkSize int, tempDir string) *externalSorter {
+	return &externalSorter{
+		less:      less,
+		chunkSize: chunkSize,
+		tempDir:   tempDir,
+		chunk:     make([]*hashdeep.Entry, 0, chunkSize),
+	}
+}
+
+func (s *externalSorter) Add(e *hashdeep.Entry) error {
+	s.chunk = append(s.chunk, e)
+	if len(s.chunk) >= s.chunkSize {
+		return s.spill()
+	}
+
+	return nil
+}
+
+// Sort returns an iterator over everything added so far, in sorted order.
+// The iterator must be drained before Close is called.
+func (s *externalSorter) Sort() (entryIterator, error) {
+	s.sortChunk()
+
+	// Everything fits in memory, no need to touch the disk
+	if len(s.runs) == 0 {
+		chunk := s.chunk
+		s.chunk = nil
+		return &sliceIterator{entries: chunk}, nil
+	}
+
+	if err := s.spill(); err != nil {
+		return nil, err
+	}
+
+	merger := &runMerger{less: s.less}
+	for _, run := range s.runs {
+		r, err := openRun(run)
+		if err != nil {
+			merger.close()
+			return nil, err
+		}
+		merger.readers = append(merger.readers, r)
+
+		if err := merger.advance(r); err != nil {
+			merger.close()
+			return nil, err
+		}
+	}
+	heap.Init(merger)
+
+	return merger, nil
+}
+
+// Close removes all temporary files.
+func (s *externalSorter) Close() {
+	for _, run := range s.runs {
+		_ = os.Remove(run)
+	}
+	s.runs = nil
+	s.chunk = nil
+}
+
+func (s *externalSorter) sortChunk() {
+	sort.SliceStable(s.chunk, func(i, j int) bool {
+		return s.less(s.chunk[i], s.chunk[j])
+	})
+}
+
+func (s *externalSorter) spill() error {
+	if len(s.chunk) == 0 {
+		return nil
+	}
+	s.sortChunk()
+
+	file, err := os.CreateTemp(s.tempDir, "az-blob-hashdeep-sort-*")
+	if err != nil {
+		return errors.Wrap(err, "could not create temporary sort file")
+	}
+	s.runs = append(s.runs, file.Name())
+
+	w := bufio.NewWriterSize(file, 64*1024)
+	encoder := gob.NewEncoder(w)
+	for _, e := range s.chunk {
+		if err := encoder.Encode(e); err != nil {
+			_ = file.Close()
+			return errors.Wrapf(err, "could not write temporary sort file '%s'", file.Name())
+		}
+	}
+
+	if err := w.Flush(); err != nil {
+		_ = file.Close()
+		return errors.Wrapf(err, "could not flush temporary sort file '%s'", file.Name())
+	}
+	if err := file.Close(); err != nil {
+		return errors.Wrapf(err, "could not close temporary sort file '%s'", file.Name())
+	}
+
+	s.chunk = s.chunk[:0]
+
+	return nil
+}
+
+type sliceIterator struct {
+	entries []*hashdeep.Entry
+	pos     int
+}
+
+func (i *sliceIterator) Next() (*hashdeep.Entry, error) {
+	if i.pos >= len(i.entries) {
+		return nil, io.EOF
+	}
+	e := i.entries[i.pos]
+	i.entries[i.pos] = nil
+	i.pos++
+
+	return e, nil
+}
+
+type runReader struct {
+	file    *os.File
+	decoder *gob.Decoder
+	head    *hashdeep.Entry
+}
+
+func openRun(path string) (*runReader, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not open temporary sort file '%s'", path)
+	}
+
+	return &runReader{
+		file:    file,
+		decoder: gob.NewDecoder(bufio.NewReaderSize(file, 64*1024)),
+	}, nil
+}
+
+// K-way merge of sorted runs, implementing heap.Interface over the run heads
+type runMerger struct {
+	less    entryLess
+	readers []*runReader
+	active  []*runReader
+}
+
+func (m *runMerger) Len() int           { return len(m.active) }
+func (m *runMerger) Less(i, j int) bool { return m.less(m.active[i].head, m.active[j].head) }
+func (m *runMerger) Swap(i, j int)      { m.active[i], m.active[j] = m.active[j], m.active[i] }
+func (m *runMerger) Push(x interface{}) { m.active = append(m.active, x.(*runReader)) }
+func (m *runMerger) Pop() interface{} {
+	last := m.active[len(m.active)-1]
+	m.active = m.active[:len(m.active)-1]
+	return last
+}
+
+func (m *runMerger) Next() (*hashdeep.Entry, error) {
+	if len(m.active) == 0 {
+		m.close()
+		return nil, io.EOF
+	}
+
+	r := m.active[0]
+	e := r.head
+	r.head = nil
+
+	if err := r.decode(); err != nil {
+		m.close()
+		return nil, err
+	}
+
+	if r.head == nil {
+		heap.Pop(m)
+	} else {
+		heap.Fix(m, 0)
+	}
+
+	return e, nil
+}
+
+// Reads the first entry of a run and registers it as active
+func (m *runMerger) advance(r *runReader) error {
+	if err := r.decode(); err != nil {
+		return err
+	}
+	if r.head != nil {
+		m.active = append(m.active, r)
+	}
+
+	return nil
+}
+
+func (m *runMerger) close() {
+	for _, r := range m.readers {
+		_ = r.file.Close()
+	}
+	m.readers = nil
+	m.active = nil
+}
+
+func (r *runReader) decode() error {
+	e := &hashdeep.Entry{}
+	if err := r.decoder.Decode(e); err != nil {
+		if err == io.EOF {
+			return nil
+		}
+		return errors.Wrapf(err, "could not read temporary sort file '%s'", r.file.Name())
+	}
+	r.head = e
+
+	return nil
+}
@@ -0,0 +1,422 @@
+/*
+Copyright © 2019 Even Holthe
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package internal
+
+import (
+	"bufio"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob"
+	"github.com/bmatcuk/doublestar/v4"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// Patterns with this prefix are regular expressions instead of globs
+const regexPrefix = "regex:"
+
+// A glob or regular expression matched against blob names
+type namePattern struct {
+	source string
+	glob   string
+	regex  *regexp.Regexp
+}
+
+// Compiles a pattern. Globs support ** and are matched against the base name
+// when they contain no slash, like in .gitignore, so *.tmp matches at any
+// depth. Regular expressions are matched anywhere in the full name unless
+// anchored.
+func newNamePattern(pattern string) (*namePattern, error) {
+	if strings.HasPrefix(pattern, regexPrefix) {
+		regex, err := regexp.Compile(strings.TrimPrefix(pattern, regexPrefix))
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid regular expression '%s'", pattern)
+		}
+
+		return &namePattern{source: pattern, regex: regex}, nil
+	}
+
+	if !doublestar.ValidatePattern(pattern) {
+		return nil, errors.Errorf("invalid glob '%s'", pattern)
+	}
+
+	return &namePattern{source: pattern, glob: pattern}, nil
+}
+
+func (p *namePattern) matches(name string) bool {
+	if p.regex != nil {
+		return p.regex.MatchString(name)
+	}
+
+	if !strings.Contains(p.glob, "/") {
+		name = path.Base(name)
+	}
+	matched, _ := doublestar.Match(p.glob, name)
+
+	return matched
+}
+
+// Decides which listed blobs are hashed
+type blobFilter struct {
+	include []*namePattern
+	exclude []*namePattern
+	// Zero values disable the property filters
+	minSize        int64
+	maxSize        int64
+	modifiedAfter  time.Time
+	modifiedBefore time.Time
+	contentTypes   []string
+	tiers          []azblob.AccessTier
+}
+
+func newBlobFilter(include []string, exclude []string) (*blobFilter, error) {
+	f := &blobFilter{}
+
+	for _, pattern := range include {
+		p, err := newNamePattern(pattern)
+		if err != nil {
+			return nil, err
+		}
+		f.include = append(f.include, p)
+	}
+
+	for _, pattern := range exclude {
+		p, err := newNamePattern(pattern)
+		if err != nil {
+			return nil, err
+		}
+		f.exclude = append(f.exclude, p)
+	}
+
+	return f, nil
+}
+
+// Reports whether a blob should be hashed. A blob must match at least one
+// include pattern, if any, and none of the exclude patterns.
+func (f *blobFilter) matches(item azblob.BlobItemInternal) bool {
+	if f == nil {
+		return true
+	}
+
+	name := *item.Name
+	if !f.matchesName(name) {
+		return false
+	}
+
+	if reason := f.rejectProperties(item.Properties); reason != "" {
+		log.Debugf("skipping %s: %s", name, reason)
+		return false
+	}
+
+	return true
+}
+
+// Reports whether a name matches at least one include pattern, if any, and none of the exclude patterns
+func (f *blobFilter) matchesName(name string) bool {
+	if len(f.include) > 0 {
+		included := false
+		for _, p := range f.include {
+			if p.matches(name) {
+				included = true
+				break
+			}
+		}
+		if !included {
+			log.Debugf("skipping %s: not included", name)
+			return false
+		}
+	}
+
+	for _, p := range f.exclude {
+		if p.matches(name) {
+			log.Debugf("skipping %s: excluded by %s", name, p.source)
+			return false
+		}
+	}
+
+	return true
+}
+
+// Returns why a blob is rejected by the property filters, empty when it is not
+func (f *blobFilter) rejectProperties(p *azblob.BlobPropertiesInternal) string {
+	if p == nil {
+		p = &azblob.BlobPropertiesInternal{}
+	}
+
+	var size int64
+	if p.ContentLength != nil {
+		size = *p.ContentLength
+	}
+	if f.minSize > 0 && size < f.minSize {
+		return "smaller than minimum size"
+	}
+	if f.maxSize > 0 && size > f.maxSize {
+		return "larger than maximum size"
+	}
+
+	if !f.modifiedAfter.IsZero() && (p.LastModified == nil || !p.LastModified.After(f.modifiedAfter)) {
+		return "not modified after " + f.modifiedAfter.Format(time.RFC3339)
+	}
+	if !f.modifiedBefore.IsZero() && (p.LastModified == nil || !p.LastModified.Before(f.modifiedBefore)) {
+		return "not modified before " + f.modifiedBefore.Format(time.RFC3339)
+	}
+
+	if len(f.contentTypes) > 0 {
+		var contentType string
+		if p.ContentType != nil {
+			contentType = *p.ContentType
+		}
+		if !matchesContentType(f.contentTypes, contentType) {
+			return "content type " + contentType + " not included"
+		}
+	}
+
+	if len(f.tiers) > 0 {
+		if p.AccessTier == nil {
+			return "unknown access tier"
+		}
+		included := false
+		for _, tier := range f.tiers {
+			if strings.EqualFold(string(tier), string(*p.AccessTier)) {
+				included = true
+				break
+			}
+		}
+		if !included {
+			return "access tier " + string(*p.AccessTier) + " not included"
+		}
+	}
+
+	return ""
+}
+
+// Matches a content type against types such as text/plain or wildcards such as image/*, ignoring parameters and case
+func matchesContentType(patterns []string, contentType string) bool {
+	contentType = strings.ToLower(strings.TrimSpace(strings.SplitN(contentType, ";", 2)[0]))
+
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(strings.TrimSpace(pattern))
+		if pattern == contentType {
+			return true
+		}
+		if strings.HasSuffix(pattern, "/*") && strings.HasPrefix(contentType, strings.TrimSuffix(pattern, "*")) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Access tiers accepted by the tier filter
+var filterTiers = []azblob.AccessTier{azblob.AccessTierHot, azblob.AccessTierCool, azblob.AccessTierArchive}
+
+func parseTiers(names []string) ([]azblob.AccessTier, error) {
+	tiers := make([]azblob.AccessTier, 0, len(names))
+
+	for _, name := range names {
+		found := false
+		for _, tier := range filterTiers {
+			if strings.EqualFold(strings.TrimSpace(name), string(tier)) {
+				tiers = append(tiers, tier)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, errors.Errorf("unknown access tier '%s', expected hot, cool or archive", name)
+		}
+	}
+
+	return tiers, nil
+}
+
+// Size units, case insensitive. KB, MB, GB and TB are decimal, KiB, MiB, GiB
+// and TiB binary. The single letters K, M, G and T are binary, as in du and ls.
+var sizeUnits = map[string]int64{
+	"":    1,
+	"b":   1,
+	"k":   1 << 10,
+	"kb":  1000,
+	"kib": 1 << 10,
+	"m":   1 << 20,
+	"mb":  1000 * 1000,
+	"mib": 1 << 20,
+	"g":   1 << 30,
+	"gb":  1000 * 1000 * 1000,
+	"gib": 1 << 30,
+	"t":   1 << 40,
+	"tb":  1000 * 1000 * 1000 * 1000,
+	"tib": 1 << 40,
+}
+
+// Parses sizes such as 1024, 10MB or 1.5GiB. An empty string is zero.
+func parseSize(value string) (int64, error) {
+	size := strings.ToLower(strings.TrimSpace(value))
+	if size == "" {
+		return 0, nil
+	}
+
+	split := strings.IndexFunc(size, func(r rune) bool {
+		return (r < '0' || r > '9') && r != '.'
+	})
+	number, unit := size, ""
+	if split >= 0 {
+		number, unit = size[:split], strings.TrimSpace(size[split:])
+	}
+
+	multiplier, ok := sizeUnits[unit]
+	parsed, err := strconv.ParseFloat(number, 64)
+	if !ok || err != nil || parsed < 0 {
+		return 0, errors.Errorf("invalid size '%s'", value)
+	}
+
+	return int64(parsed * float64(multiplier)), nil
+}
+
+// Parses RFC 3339 timestamps or dates (YYYY-MM-DD, midnight UTC). An empty string is the zero time.
+func parseTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	if t, err := time.Parse("2006-01-02", value); err == nil {
+		return t, nil
+	}
+
+	return time.Time{}, errors.Errorf("invalid time '%s', expected YYYY-MM-DD or RFC 3339", value)
+}
+
+// Adds the property filters of a config to the filter
+func (f *blobFilter) setProperties(c *TraversalConfig) error {
+	var err error
+
+	if f.minSize, err = parseSize(c.MinSize); err != nil {
+		return err
+	}
+	if f.maxSize, err = parseSize(c.MaxSize); err != nil {
+		return err
+	}
+	if f.maxSize > 0 && f.minSize > f.maxSize {
+		return errors.New("minimum size is larger than maximum size")
+	}
+
+	if f.modifiedAfter, err = parseTime(c.ModifiedAfter); err != nil {
+		return err
+	}
+	if f.modifiedBefore, err = parseTime(c.ModifiedBefore); err != nil {
+		return err
+	}
+	if !f.modifiedAfter.IsZero() && !f.modifiedBefore.IsZero() && !f.modifiedAfter.Before(f.modifiedBefore) {
+		return errors.New("modified after must be earlier than modified before")
+	}
+
+	f.contentTypes = c.ContentTypes
+	if f.tiers, err = parseTiers(c.Tiers); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Reads patterns from a file, one per line. Blank lines and lines starting with # are ignored.
+func readPatterns(file string) ([]string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var patterns []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		patterns = append(patterns, line)
+	}
+
+	return patterns, scanner.Err()
+}
+
+// Sorts and de-duplicates listing prefixes, dropping those covered by a
+// shorter prefix so that no blob is listed twice. Listing the prefixes in
+// order yields blobs in name order, like a listing of the whole container.
+func normalizePrefixes(prefixes []string) []string {
+	sorted := make([]string, 0, len(prefixes))
+	for _, prefix := range prefixes {
+		if prefix == "" {
+			// The whole container
+			return nil
+		}
+		sorted = append(sorted, prefix)
+	}
+	sort.Strings(sorted)
+
+	var normalized []string
+	for _, prefix := range sorted {
+		if n := len(normalized); n > 0 && strings.HasPrefix(prefix, normalized[n-1]) {
+			continue
+		}
+		normalized = append(normalized, prefix)
+	}
+
+	return normalized
+}
+
+// Returns the prefixes to list, a single empty prefix for the whole container
+func (c *TraversalConfig) listingPrefixes() []string {
+	if len(c.IncludePrefixes) == 0 {
+		return []string{""}
+	}
+
+	return c.IncludePrefixes
+}
+
+// Returns the additional datasets to request in listings
+func (c *TraversalConfig) listingDetails() []azblob.ListBlobsIncludeItem {
+	var include []azblob.ListBlobsIncludeItem
+	if c.IncludeVersions {
+		include = append(include, azblob.ListBlobsIncludeItemVersions)
+	}
+	if c.IncludeSnapshots {
+		include = append(include, azblob.ListBlobsIncludeItemSnapshots)
+	}
+	if c.IncludeDeleted {
+		include = append(include, azblob.ListBlobsIncludeItemDeleted)
+	}
+
+	return include
+}
+
+// Returns the path of a blob in the output, without the include prefix when it is stripped
+func (c *TraversalConfig) relativePath(name string) string {
+	if !c.StripPrefix {
+		return name
+	}
+
+	// Validation ensures a single prefix is stripped
+	return strings.TrimPrefix(name, c.IncludePrefixes[0])
+}
@@ -0,0 +1,106 @@
+/*
+Copyright © 2019 Even Holthe
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package internal
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    int64
+		wantErr bool
+	}{
+		{in: "", want: 0},
+		{in: "1024", want: 1024},
+		{in: "10b", want: 10},
+		{in: "1k", want: 1024},
+		{in: "1K", want: 1024},
+		{in: "1kb", want: 1000},
+		{in: "1KiB", want: 1024},
+		{in: "10MB", want: 10 * 1000 * 1000},
+		{in: "10M", want: 10 << 20},
+		{in: "10MiB", want: 10 << 20},
+		{in: "1.5GiB", want: 3 << 29},
+		{in: "1.5GB", want: 1500 * 1000 * 1000},
+		{in: "2g", want: 2 << 30},
+		{in: "1TB", want: 1000 * 1000 * 1000 * 1000},
+		{in: "1t", want: 1 << 40},
+		{in: " 5 MB ", want: 5 * 1000 * 1000},
+		{in: ".5k", want: 512},
+		{in: "10XB", wantErr: true},
+		{in: "MB", wantErr: true},
+		{in: "-1", wantErr: true},
+		{in: "1.2.3", wantErr: true},
+		{in: "1e3", wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.in, func(t *testing.T) {
+			got, err := parseSize(test.in)
+			if test.wantErr {
+				if err == nil {
+					t.Errorf("parseSize(%q) = %d, want an error", test.in, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseSize(%q): %v", test.in, err)
+			}
+			if got != test.want {
+				t.Errorf("parseSize(%q) = %d, want %d", test.in, got, test.want)
+			}
+		})
+	}
+}
+
+func TestParseTime(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    time.Time
+		wantErr bool
+	}{
+		{in: "", want: time.Time{}},
+		{in: "2024-01-31", want: time.Date(2024, 1, 31, 0, 0, 0, 0, time.UTC)},
+		{in: "2024-01-31T12:00:00Z", want: time.Date(2024, 1, 31, 12, 0, 0, 0, time.UTC)},
+		{in: "2024-01-31T12:00:00+01:00", want: time.Date(2024, 1, 31, 11, 0, 0, 0, time.UTC)},
+		{in: "2024-01-31T12:00:00.5Z", want: time.Date(2024, 1, 31, 12, 0, 0, 500000000, time.UTC)},
+		{in: "2024-01-31 12:00:00", wantErr: true},
+		{in: "31.01.2024", wantErr: true},
+		{in: "2024-02-30", wantErr: true},
+		{in: "yesterday", wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.in, func(t *testing.T) {
+			got, err := parseTime(test.in)
+			if test.wantErr {
+				if err == nil {
+					t.Errorf("parseTime(%q) = %v, want an error", test.in, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseTime(%q): %v", test.in, err)
+			}
+			if !got.Equal(test.want) {
+				t.Errorf("parseTime(%q) = %v, want %v", test.in, got, test.want)
+			}
+		})
+	}
+}
@@ -34,34 +34,142 @@ const maxAzResults int32 = 5000
 const channelSize = maxAzResults * 2
 const progressInterval = 5 * time.Minute
 
-func Generate(ctx context.Context, c *GenerateConfig) {
-	var wg sync.WaitGroup
+// Generate writes the output for a single container, every container of the
+// account or a local directory, and reports whether it succeeded, which is
+// not the case for a failed audit, an incomplete listing, blobs that could
+// not be hashed or a cancelled run.
+func Generate(ctx context.Context, c *GenerateConfig) bool {
+	if c.AllContainers {
+		return generateAccount(ctx, c)
+	}
+	if len(c.Sources) > 0 {
+		return generateSources(ctx, c)
+	}
+
+	what := fmt.Sprintf("container '%s'", c.Container)
+	if c.Directory != "" {
+		what = fmt.Sprintf("directory '%s'", c.Directory)
+	}
+
+	return generate(ctx, c, []*source{{config: &c.TraversalConfig}}, false, what)
+}
+
+// Writes the output for the sources, described by what in the log. A
+// combined output of several sources is hashed in no particular order, so it
+// is sorted by path once complete.
+func generate(ctx context.Context, c *GenerateConfig, sources []*source, combined bool, what string) bool {
+	var (
+		wg       sync.WaitGroup
+		writer   entryWriter
+		audit    *AuditOutputFile
+		manifest *HashdeepOutputFile
+	)
 	files := make(chan *HashdeepEntry, channelSize)
-	writer := &HashdeepOutputFile{OutputFile: c.OutputFile, PathPrefix: c.Prefix}
+
+	if c.Mode == ModeNone {
+		manifest = &HashdeepOutputFile{OutputFile: c.OutputFile, PathPrefix: c.Prefix, Algorithms: c.Algorithms, Resume: c.Resume, WriteState: c.WriteState, Deleted: c.IncludeDeleted}
+		writer = manifest
+	} else {
+		known, err := loadKnownHashes(c.KnownFiles, c.Algorithms)
+		if err != nil {
+			log.Fatalf("error while loading known hashes: %v", err)
+		}
+		audit = &AuditOutputFile{OutputFile: c.OutputFile, PathPrefix: c.Prefix, Mode: c.Mode, Verbosity: c.Verbosity, Known: known}
+		writer = audit
+	}
+
 	if err := writer.Open(); err != nil {
 		log.Fatalf("error while configuring output: %v", err)
 	}
 
-	configureSubscriber(ctx, files, writer, &wg)
-	traverseBlobStorage(ctx, files, c)
+	var options traversalOptions
+	if manifest != nil {
+		options.progress = manifest.Checkpoint()
+	}
+	if c.PreviousManifest != "" {
+		previous, err := loadState(c.PreviousManifest)
+		if err != nil {
+			log.Fatalf("error while loading previous state: %v", err)
+		}
+		log.Infof("loaded state of %d blobs from %s", len(previous), c.PreviousManifest)
+		options.previous = previous
+	}
+
+	log.Infof("results will be saved to %s", c.OutputFile)
+	if c.IncludeDeleted {
+		log.Infof("deleted blobs will be saved to %s", c.OutputFile+deletedSuffix)
+	}
+	var (
+		failed   uint64
+		closeErr error
+	)
+	configureSubscriber(ctx, files, writer, &failed, &closeErr, &wg)
+	listed := traverseSources(ctx, files, sources, c.WorkerCount, options)
 
 	log.Debugf("awaiting wg")
 	wg.Wait()
-	log.Info("all done, exiting!")
-	os.Exit(0)
+
+	if closeErr != nil {
+		log.Errorf("could not close the output of %s: %v", what, closeErr)
+		return false
+	}
+	if ctx.Err() != nil {
+		log.Errorf("%s was cancelled before completion", what)
+		return false
+	}
+
+	if combined && manifest != nil && manifest.Finished() {
+		if err := manifest.Sort(); err != nil {
+			log.Errorf("could not sort %s: %v", c.OutputFile, err)
+			return false
+		}
+	}
+
+	if !listed {
+		log.Errorf("%s could not be listed completely", what)
+		return false
+	}
+	if failed > 0 {
+		log.Errorf("%d entries of %s could not be hashed or written", failed, what)
+		return false
+	}
+	var skipped uint64
+	for _, s := range sources {
+		if !s.config.IgnoreSkippedFiles {
+			skipped += s.skipped
+		}
+	}
+	if skipped > 0 {
+		log.Errorf("%d files or directories of %s were skipped, pass --ignore-skipped-files to accept this", skipped, what)
+		return false
+	}
+
+	if audit != nil && audit.Failed() {
+		log.Errorf("audit of %s failed", what)
+		return false
+	}
+
+	log.Infof("done with %s", what)
+	return true
 }
 
-func configureSubscriber(ctx context.Context, files chan *HashdeepEntry, writer *HashdeepOutputFile, wg *sync.WaitGroup) {
+// Writes the entries, counting those that failed to hash or could not be
+// written in failed. The writer is closed once files is closed or the run is
+// cancelled, and the error of closing it is stored in closeErr.
+func configureSubscriber(ctx context.Context, files chan *HashdeepEntry, writer entryWriter, failed *uint64, closeErr *error, wg *sync.WaitGroup) {
 	logger := log.WithField("phase", "results_writer")
 	var count uint64 = 0
 
 	wg.Add(1)
 
 	go func() {
-		defer writer.Close()
 		defer wg.Done()
+		defer func() {
+			*closeErr = writer.Close()
+		}()
 
 		progressTicker := time.NewTicker(progressInterval)
+		defer progressTicker.Stop()
 
 		for {
 			select {
@@ -70,81 +178,203 @@ func configureSubscriber(ctx context.Context, files chan *HashdeepEntry, writer
 				return
 			case <-progressTicker.C:
 				logger.Infof("processed so far: %d", count)
-			default:
-				fileEntry, more := <-files
-				if more {
-					if err := writer.WriteEntry(fileEntry); err != nil {
-						log.Warn(err)
-					}
-
-					atomic.AddUint64(&count, 1)
-				} else {
+			case fileEntry, more := <-files:
+				if !more {
 					logger.Infof("processed totally %d entries", count)
 					return
 				}
+				if fileEntry.status == statusFailed {
+					atomic.AddUint64(failed, 1)
+				}
+				if err := writer.WriteEntry(fileEntry); err != nil {
+					log.Error(err)
+					atomic.AddUint64(failed, 1)
+				}
+
+				atomic.AddUint64(&count, 1)
 			}
 		}
 	}()
 }
 
-func traverseBlobStorage(ctx context.Context, files chan *HashdeepEntry, c *GenerateConfig) {
+// Optional behaviour of a traversal
+type traversalOptions struct {
+	// Resume the listing from its marker and skip blobs completed earlier
+	progress *checkpoint
+	// Reuse the digests of blobs that are unchanged since a previous run
+	previous map[string]*blobState
+}
+
+// Lists the container and hashes its blobs, reporting whether it was listed completely
+func traverseBlobStorage(ctx context.Context, files chan *HashdeepEntry, c *TraversalConfig, options traversalOptions) bool {
+	return traverseSources(ctx, files, []*source{{config: c}}, c.WorkerCount, options)
+}
+
+// Lists the sources in the order of their keys and hashes their blobs with a
+// shared pool of workers, reporting whether every source was listed completely
+func traverseSources(ctx context.Context, files chan *HashdeepEntry, sources []*source, workerCount int, options traversalOptions) bool {
 	logger := log.WithField("phase", "storage_account_container_traversal")
-	container := azureCheck(ctx, c)
-
-	// Configure hashing strategy
-	var hasher hashes.Hasher
-	if c.Calculate {
-		logger.Info("hashing strategy: Download files and calculate hashes locally")
-		hasher = &hashes.DownloadAndCalculateHasher{
-			Client: &container,
-		}
-		// hasher = &hashes.BuiltinDownloadAndCalculateHasher{
-		// 	Client: &container,
-		// }
-	} else {
-		logger.Info("hashing strategy: Use hash from blob metadata")
-		hasher = &hashes.MetadataHasher{}
+	// Ends the results writer, also when the traversal is cancelled
+	defer close(files)
+
+	caches := hashCaches{}
+	defer caches.close(logger)
+	for _, s := range sources {
+		s.connect(ctx, caches, options.previous)
 	}
-	hashJobs, workersGroup := configureBackgroundWorkers(ctx, c.WorkerCount, hasher, files)
+	progress := options.progress
+
+	hashJobs, workersGroup := configureBackgroundWorkers(ctx, workerCount, files)
 
 	// Do the traversal
-	logger.Infof("starting traversal, results will be saved to %s", c.OutputFile)
-	pager := container.ListBlobsFlat(&azblob.ContainerListBlobFlatSegmentOptions{
+	logger.Info("starting traversal")
+	listed := true
+	for _, s := range sources {
+		if progress != nil && s.key < progress.resumeSource() {
+			continue
+		}
+
+		for _, prefix := range s.config.listingPrefixes() {
+			marker := ""
+			if progress != nil && s.key == progress.resumeSource() {
+				if prefix < progress.resumePrefix() {
+					continue
+				}
+				if prefix == progress.resumePrefix() {
+					marker = progress.resumeMarker()
+				}
+			}
+
+			err := s.list(ctx, prefix, marker, progress, hashJobs)
+			if ctx.Err() != nil {
+				logger.Warn("force-stopping traversal")
+				close(hashJobs)
+				// The caches are closed upon return, but may still be in use by the workers
+				workersGroup.Wait()
+				return false
+			}
+			if err != nil {
+				handleErrors("list_blobs", err)(logger)
+				listed = false
+				break
+			}
+		}
+		if !listed {
+			break
+		}
+	}
+	logger.Debugf("queued up all jobs")
+	close(hashJobs)
+
+	if listed && progress != nil {
+		progress.finishListing()
+	}
+
+	logger.Debug("awaiting workersGroup")
+	workersGroup.Wait()
+
+	for _, s := range sources {
+		if s.pending != nil && len(s.pending.items) > 0 {
+			awaitRehydration(ctx, s, workerCount, files)
+		}
+	}
+
+	if options.previous != nil {
+		var reused uint64
+		for _, s := range sources {
+			reused += atomic.LoadUint64(&s.incremental.reused)
+		}
+		logger.Infof("reused digests of %d unchanged blobs", reused)
+	}
+
+	return listed
+}
+
+// Lists the blobs of a source below prefix, starting at marker, and queues those matching the filter for hashing
+func listBlobs(ctx context.Context, s *source, prefix string, marker string, progress *checkpoint, hashJobs chan<- hashJob) error {
+	logger := log.WithField("phase", "storage_account_container_traversal")
+
+	listOptions := &azblob.ContainerListBlobFlatSegmentOptions{
+		Include:    s.config.listingDetails(),
 		Maxresults: pointy.Int32(maxAzResults),
-	})
+	}
+	if prefix != "" {
+		logger.Infof("listing blobs with prefix %s", prefix)
+		listOptions.Prefix = pointy.String(prefix)
+	}
+	if marker != "" {
+		logger.Infof("resuming traversal from marker %s", marker)
+		listOptions.Marker = pointy.String(marker)
+	}
+
+	pager := s.container.ListBlobsFlat(listOptions)
 
 	for pager.NextPage(ctx) {
 		resp := pager.PageResponse()
 		logger.Debugf("page=%s", *resp.ContainerListBlobFlatSegmentResult.RequestID)
+
+		jobs := make([]azblob.BlobItemInternal, 0, len(resp.ContainerListBlobFlatSegmentResult.Segment.BlobItems))
 		for _, blobInfo := range resp.ContainerListBlobFlatSegmentResult.Segment.BlobItems {
-			if blobInfo != nil {
-				hashJobs <- *blobInfo
-			} else {
+			if blobInfo == nil {
 				logger.Warnf("encountered a nil blob in response from Azure")
+				continue
+			}
+			if !s.config.filter.matches(*blobInfo) {
+				continue
 			}
+			if progress != nil && progress.skip(s.id(*blobInfo)) {
+				continue
+			}
+			jobs = append(jobs, *blobInfo)
+		}
+
+		if progress != nil {
+			trackPage(progress, s, prefix, &resp.ContainerListBlobFlatSegmentResult.ListBlobsFlatSegmentResponse, jobs)
+		}
 
+		for _, job := range jobs {
 			select {
+			case hashJobs <- hashJob{item: job, source: s}:
 			case <-ctx.Done():
-				logger.Warn("force-stopping traversal")
-				close(hashJobs)
-				return
-			default:
+				return ctx.Err()
 			}
 		}
 	}
-	logger.Debugf("queued up all jobs")
-	close(hashJobs)
 
-	if err := pager.Err(); err != nil {
-		handleErrors("list_blobs", err)(logger)
+	return pager.Err()
+}
+
+func closeCache(cache *hashes.Cache, logger *log.Entry) {
+	hits, misses := cache.Stats()
+	logger.Infof("hash cache: %d hits, %d misses", hits, misses)
+
+	if err := cache.Close(); err != nil {
+		logger.Warnf("could not close hash cache: %v", err)
 	}
+}
 
-	logger.Debug("awaiting workersGroup")
-	workersGroup.Wait()
-	close(files)
+// Registers a listed page with the checkpoint before its blobs are queued
+func trackPage(progress *checkpoint, s *source, prefix string, page *azblob.ListBlobsFlatSegmentResponse, jobs []azblob.BlobItemInternal) {
+	var marker, first string
+	if page.Marker != nil {
+		marker = *page.Marker
+	}
+	for _, blobInfo := range page.Segment.BlobItems {
+		if blobInfo != nil {
+			first = s.key + *blobInfo.Name
+			break
+		}
+	}
+
+	names := make([]string, 0, len(jobs))
+	for _, job := range jobs {
+		names = append(names, s.id(job))
+	}
+
+	progress.listed(s.key, prefix, marker, first, names)
 }
 
-func azureCheck(ctx context.Context, c *GenerateConfig) azblob.ContainerClient {
+func azureCheck(ctx context.Context, c *TraversalConfig) azblob.ContainerClient {
 	logger := log.WithField("phase", "azure_checks")
 	logger.Infof("request to traverse container '%s' from storage account '%s' – initiating self-test...", c.Container, c.AccountName)
 
@@ -167,10 +397,8 @@ func azureCheck(ctx context.Context, c *GenerateConfig) azblob.ContainerClient {
 	return container
 }
 
-func configureContainerClient(c *GenerateConfig) (azblob.ContainerClient, error) {
-	logger := log.WithField("phase", "configure_auth")
-	u := fmt.Sprintf("https://%s.blob.core.windows.net/%s", c.AccountName, c.Container)
-	opts := &azblob.ClientOptions{
+func clientOptions(c *TraversalConfig) *azblob.ClientOptions {
+	return &azblob.ClientOptions{
 		Transporter: customHttpClient(c.WorkerCount*2, 10*time.Second),
 		Retry: policy.RetryOptions{
 			MaxRetries:    3,
@@ -178,19 +406,62 @@ func configureContainerClient(c *GenerateConfig) (azblob.ContainerClient, error)
 			MaxRetryDelay: 3 * 3,
 		},
 	}
+}
 
-	if len(c.SasToken) > 0 {
+func configureContainerClient(c *TraversalConfig) (azblob.ContainerClient, error) {
+	logger := log.WithField("phase", "configure_auth")
+	u := c.containerURL()
+	opts := clientOptions(c)
+
+	switch c.Auth {
+	case AuthSas:
 		logger.Infof("Using SAS token")
 		sasFormat := fmt.Sprintf("%s?%s", u, c.SasToken)
 		return azblob.NewContainerClientWithNoCredential(sasFormat, opts)
+	case AuthSharedKey:
+		logger.Infof("Using Account Key")
+		credential, err := azblob.NewSharedKeyCredential(c.AccountName, c.AccountKey)
+		if err != nil {
+			log.Fatalf("could not configure account key: %+v", err)
+		}
+
+		return azblob.NewContainerClientWithSharedKey(u, credential, opts)
+	}
+
+	logger.Infof("Using Entra ID authentication: %s", c.Auth)
+	credential, err := tokenCredential(c)
+	if err != nil {
+		return azblob.ContainerClient{}, err
+	}
+
+	return azblob.NewContainerClient(u, credential, opts)
+}
+
+func configureServiceClient(c *TraversalConfig) (azblob.ServiceClient, error) {
+	logger := log.WithField("phase", "configure_auth")
+	u := c.serviceURL()
+	opts := clientOptions(c)
+
+	switch c.Auth {
+	case AuthSas:
+		logger.Infof("Using SAS token")
+		sasFormat := fmt.Sprintf("%s?%s", u, c.SasToken)
+		return azblob.NewServiceClientWithNoCredential(sasFormat, opts)
+	case AuthSharedKey:
+		logger.Infof("Using Account Key")
+		credential, err := azblob.NewSharedKeyCredential(c.AccountName, c.AccountKey)
+		if err != nil {
+			log.Fatalf("could not configure account key: %+v", err)
+		}
+
+		return azblob.NewServiceClientWithSharedKey(u, credential, opts)
 	}
 
-	// Account key
-	logger.Infof("Using Account Key")
-	credential, err := azblob.NewSharedKeyCredential(c.AccountName, c.AccountKey)
+	logger.Infof("Using Entra ID authentication: %s", c.Auth)
+	credential, err := tokenCredential(c)
 	if err != nil {
-		log.Fatalf("could not configure account key: %+v", err)
+		return azblob.ServiceClient{}, err
 	}
 
-	return azblob.NewContainerClientWithSharedKey(u, credential, opts)
+	return azblob.NewServiceClient(u, credential, opts)
 }
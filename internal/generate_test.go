@@ -0,0 +1,254 @@
+/*
+Copyright © 2019 Even Holthe
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package internal
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Creates the files below dir, keyed by their slash separated names
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+
+	for name, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func localGenerateConfig(t *testing.T, dir string, output string, resume bool) *GenerateConfig {
+	t.Helper()
+
+	c, err := NewGenerateConfig(TraversalConfig{Directory: dir, Algorithms: []string{"md5"}, WorkerCount: 2}, nil, output, resume, true, "", nil, ModeNone, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return c
+}
+
+func TestGenerateResumeLocalDirectory(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{"a.txt": "a", "b/c.txt": "c", "b/d.txt": "d", "b-e.txt": "e", "f.txt": "f"}
+	writeFiles(t, dir, files)
+	entry := func(name string) *HashdeepEntry {
+		digest := md5.Sum([]byte(files[name]))
+		return &HashdeepEntry{size: int64(len(files[name])), hashes: map[string]string{"md5": hex.EncodeToString(digest[:])}, path: name, name: name, lastModified: time.Now()}
+	}
+
+	// The interrupted run completed the first page, and b/d.txt of the second
+	// page, before it was killed while writing b-e.txt
+	output := filepath.Join(t.TempDir(), "out.hashdeep")
+	h := &HashdeepOutputFile{OutputFile: output, Algorithms: []string{"md5"}, WriteState: true}
+	if err := h.Open(); err != nil {
+		t.Fatal(err)
+	}
+	h.Checkpoint().listed("", "", "", "a.txt", []string{"a.txt"})
+	h.Checkpoint().listed("", "", "b-e.txt", "b-e.txt", []string{"b-e.txt", "b/c.txt", "b/d.txt", "f.txt"})
+	for _, name := range []string{"a.txt", "b/d.txt"} {
+		if err := h.WriteEntry(entry(name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := h.sync(); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.WriteEntry(entry("b-e.txt")); err != nil {
+		t.Fatal(err)
+	}
+	for _, err := range []error{h.writer.Flush(), h.state.flush()} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, f := range []*os.File{h.file, h.state.file, h.checkpoint.file} {
+		_ = f.Close()
+	}
+
+	if !Generate(context.Background(), localGenerateConfig(t, dir, output, true)) {
+		t.Fatal("resumed run failed")
+	}
+
+	full := filepath.Join(t.TempDir(), "full.hashdeep")
+	if !Generate(context.Background(), localGenerateConfig(t, dir, full, false)) {
+		t.Fatal("uninterrupted run failed")
+	}
+
+	got, want := readEntryLines(t, output), readEntryLines(t, full)
+	sort.Strings(got)
+	sort.Strings(want)
+	if len(want) != len(files) || !reflect.DeepEqual(got, want) {
+		t.Errorf("resumed output = %v, want %v", got, want)
+	}
+
+	names := readStateNames(t, output+stateSuffix)
+	sort.Strings(names)
+	if want := []string{"a.txt", "b-e.txt", "b/c.txt", "b/d.txt", "f.txt"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("state = %v, want %v", names, want)
+	}
+	if _, err := os.Stat(output + checkpointSuffix); !os.IsNotExist(err) {
+		t.Errorf("checkpoint of a finished run was not removed: %v", err)
+	}
+}
+
+// Records the entries written to it
+type recordingWriter struct {
+	mu       sync.Mutex
+	names    []string
+	closed   bool
+	closeErr error
+}
+
+func (w *recordingWriter) Open() error {
+	return nil
+}
+
+func (w *recordingWriter) WriteEntry(e *HashdeepEntry) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.names = append(w.names, e.name)
+	return nil
+}
+
+func (w *recordingWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.closed = true
+	return w.closeErr
+}
+
+func (w *recordingWriter) written() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return len(w.names)
+}
+
+func TestConfigureSubscriber(t *testing.T) {
+	tests := []struct {
+		name     string
+		cancel   bool
+		closeErr error
+	}{
+		{name: "end of entries"},
+		{name: "cancelled", cancel: true},
+		{name: "close error", closeErr: errors.New("disk full")},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			var (
+				wg       sync.WaitGroup
+				failed   uint64
+				closeErr error
+			)
+			files := make(chan *HashdeepEntry)
+			writer := &recordingWriter{closeErr: test.closeErr}
+			configureSubscriber(ctx, files, writer, &failed, &closeErr, &wg)
+
+			files <- &HashdeepEntry{name: "a"}
+			files <- &HashdeepEntry{name: "b", status: statusFailed}
+			// The second entry may still be in the hands of the subscriber
+			for writer.written() < 2 {
+				time.Sleep(time.Millisecond)
+			}
+			if test.cancel {
+				cancel()
+			} else {
+				close(files)
+			}
+
+			done := make(chan struct{})
+			go func() {
+				wg.Wait()
+				close(done)
+			}()
+			select {
+			case <-done:
+			case <-time.After(5 * time.Second):
+				t.Fatal("subscriber did not return")
+			}
+
+			if !writer.closed {
+				t.Error("writer was not closed")
+			}
+			if failed != 1 {
+				t.Errorf("failed = %d, want 1", failed)
+			}
+			if closeErr != test.closeErr {
+				t.Errorf("closeErr = %v, want %v", closeErr, test.closeErr)
+			}
+		})
+	}
+}
+
+func TestGenerateCancelled(t *testing.T) {
+	dir := t.TempDir()
+	files := make(map[string]string)
+	for _, name := range []string{"a.txt", "b/c.txt", "d.txt"} {
+		files[name] = name
+	}
+	writeFiles(t, dir, files)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	output := filepath.Join(t.TempDir(), "out.hashdeep")
+	c := localGenerateConfig(t, dir, output, false)
+	done := make(chan bool)
+	go func() {
+		done <- Generate(ctx, c)
+	}()
+
+	select {
+	case ok := <-done:
+		if ok {
+			t.Error("cancelled run succeeded")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("cancelled run did not return")
+	}
+
+	// Whatever was written is flushed, and the checkpoint is kept for --resume
+	progress, err := loadCheckpoint(output + checkpointSuffix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = progress.file.Close()
+	if got := fileSize(t, output); got != progress.offset {
+		t.Errorf("output is %d bytes, but the checkpoint records %d", got, progress.offset)
+	}
+}
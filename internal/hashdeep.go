@@ -23,37 +23,79 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 
+	"github.com/evenh/az-blob-hashdeep/internal/hashdeep"
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 )
 
+// Followed by the algorithms and the filename column
 const header = `%%%% HASHDEEP-1.0
-%%%% size,md5,filename`
+%%%% size,`
 
 const comment = `## Invoked from: %s
 ## $ %s
 ##`
 
 type HashdeepEntry struct {
-	size    int64
-	md5hash string
-	path    string
+	size int64
+	// Hex encoded digests keyed by algorithm name
+	hashes map[string]string
+	path   string
+	// Name of the blob, which differs from path when a prefix is stripped
+	name string
+	// Set when the blob could not be hashed, see hashes.StatusArchived and statusFailed
+	status string
+	// Soft-deleted blobs are written to a separate manifest
+	deleted bool
+	// Recorded in the state file, see blobState
+	etag         string
+	lastModified time.Time
 }
 
+// Receives the entries produced by a traversal
+type entryWriter interface {
+	Open() error
+	WriteEntry(e *HashdeepEntry) error
+	Close() error
+}
+
+// Manifest of soft-deleted blobs, stored next to the output file
+const deletedSuffix = ".deleted"
+
+// How often the output file is flushed and progress recorded in the checkpoint
+const (
+	syncEntries  = 1000
+	syncInterval = 10 * time.Second
+)
+
 type HashdeepOutputFile struct {
 	OutputFile string
 	PathPrefix string
+	Algorithms []string
+	// Append to the output file of an interrupted run, see checkpoint
+	Resume bool
+	// Write a state file for incremental runs, see blobState
+	WriteState bool
+	// Write soft-deleted blobs to a manifest next to the output file
+	Deleted    bool
 	file       *os.File
 	writer     *bufio.Writer
+	checkpoint *checkpoint
+	state      *stateWriter
+	deleted    *appendFile
+	offset     int64
+	unsynced   int
+	lastSync   time.Time
 }
 
 func (h *HashdeepOutputFile) Open() error {
-	if err := h.checkDirectoryExists(); err != nil {
-		return err
+	if h.Resume {
+		return h.reopen()
 	}
-	file, err := os.OpenFile(h.OutputFile, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0755)
 
+	file, err := createOutputFile(h.OutputFile)
 	if err != nil {
 		return err
 	}
@@ -62,47 +104,273 @@ func (h *HashdeepOutputFile) Open() error {
 
 	w := bufio.NewWriterSize(file, 1024*5)
 
-	// Write header and comment
+	h.writer = w
+	if err := h.write(h.header()); err != nil {
+		return errors.Wrapf(err, "error while writing header to output file '%s'", h.OutputFile)
+	}
+
+	h.checkpoint, err = newCheckpoint(h.OutputFile + checkpointSuffix)
+	if err != nil {
+		return err
+	}
+
+	if h.WriteState {
+		if h.state, err = newStateWriter(h.OutputFile + stateSuffix); err != nil {
+			return err
+		}
+	}
+
+	if h.Deleted {
+		if h.deleted, err = createAppendFile(h.OutputFile + deletedSuffix); err != nil {
+			return errors.Wrapf(err, "could not create manifest of deleted blobs")
+		}
+		if err := h.deleted.write(h.header()); err != nil {
+			return err
+		}
+	}
+
+	return h.sync()
+}
+
+// Returns the header and comment of a manifest
+func (h *HashdeepOutputFile) header() string {
 	cwd, err := os.Getwd()
-	args := strings.Join(os.Args, " ")
+	args := strings.Join(RedactArgs(os.Args), " ")
 
 	if err != nil {
 		cwd = "<not able to determine working directory>"
 	}
 
-	_, _ = io.WriteString(w, header+"\n")
-	_, _ = io.WriteString(w, fmt.Sprintf(comment, cwd, args)+"\n")
+	return header + strings.Join(h.Algorithms, ",") + ",filename\n" + fmt.Sprintf(comment, cwd, args) + "\n"
+}
 
-	h.writer = w
+// Opens the output file of an interrupted run, discarding anything written after the latest checkpoint record
+func (h *HashdeepOutputFile) reopen() error {
+	checkpoint, err := loadCheckpoint(h.OutputFile + checkpointSuffix)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(h.OutputFile, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+
+	algorithms, err := hashdeep.NewReader(file).Algorithms()
+	if err != nil {
+		return errors.Wrapf(err, "could not read output file '%s'", h.OutputFile)
+	}
+	if strings.Join(algorithms, ",") != strings.Join(h.Algorithms, ",") {
+		return errors.Errorf("output file '%s' contains %s, but %s was requested", h.OutputFile, strings.Join(algorithms, ","), strings.Join(h.Algorithms, ","))
+	}
+
+	if err := file.Truncate(checkpoint.offset); err != nil {
+		return err
+	}
+	if _, err := file.Seek(checkpoint.offset, io.SeekStart); err != nil {
+		return err
+	}
+
+	if checkpoint.stateOffset > 0 && !h.WriteState {
+		return errors.New("the interrupted run wrote a state file, resume it with the same state options")
+	}
+	if h.WriteState {
+		if h.state, err = reopenStateWriter(h.OutputFile+stateSuffix, checkpoint.stateOffset); err != nil {
+			return err
+		}
+	}
+
+	if checkpoint.deletedOffset > 0 && !h.Deleted {
+		return errors.New("the interrupted run wrote a manifest of deleted blobs, resume it with the same options")
+	}
+	if h.Deleted {
+		if h.deleted, err = reopenAppendFile(h.OutputFile+deletedSuffix, checkpoint.deletedOffset); err != nil {
+			return errors.Wrapf(err, "could not open manifest of deleted blobs")
+		}
+	}
+
+	log.Infof("resuming %s with %d blobs already written in the current page", h.OutputFile, len(checkpoint.done))
+
+	h.file = file
+	h.writer = bufio.NewWriterSize(file, 1024*5)
+	h.checkpoint = checkpoint
+	h.offset = checkpoint.offset
+	h.lastSync = time.Now()
 
 	return nil
 }
 
-func (h HashdeepOutputFile) WriteEntry(e *HashdeepEntry) error {
-	_, err := h.writer.WriteString(strconv.FormatInt(e.size, 10) + "," + e.md5hash + "," + h.PathPrefix + e.path + "\n")
+// Finished reports whether the run is complete, valid after Close
+func (h *HashdeepOutputFile) Finished() bool {
+	return h.checkpoint.finished
+}
 
-	if err != nil {
+// Sort sorts the output file, and the manifest of deleted blobs, by path
+func (h *HashdeepOutputFile) Sort() error {
+	if err := sortOutputFile(h.OutputFile, h.Algorithms); err != nil {
+		return err
+	}
+	if h.deleted != nil {
+		return sortOutputFile(h.deleted.path, h.Algorithms)
+	}
+
+	return nil
+}
+
+// Checkpoint returns the progress of the run, valid after Open
+func (h *HashdeepOutputFile) Checkpoint() *checkpoint {
+	return h.checkpoint
+}
+
+func (h *HashdeepOutputFile) WriteEntry(e *HashdeepEntry) error {
+	if e.status == statusFailed {
+		// Not completed, so that a resumed run tries again
+		return nil
+	}
+
+	if e.deleted && h.deleted != nil {
+		// Kept out of the state, which only describes the live blobs
+		if err := h.deleted.write(h.line(e)); err != nil {
+			return errors.Wrapf(err, "error while writing entry to output file '%s'", h.deleted.path)
+		}
+
+		return h.completed(e)
+	}
+
+	if err := h.write(h.line(e)); err != nil {
 		return errors.Wrapf(err, "error while writing entry to output file '%s'", h.OutputFile)
 	}
 
+	if e.status != "" {
+		return h.completed(e)
+	}
+
+	if h.state != nil {
+		if err := h.state.write(newBlobState(e)); err != nil {
+			return err
+		}
+	}
+
+	return h.completed(e)
+}
+
+// Formats an entry as a line of the output file
+func (h *HashdeepOutputFile) line(e *HashdeepEntry) string {
+	if e.status != "" {
+		// Not hashed, recorded as a comment that hashdeep ignores
+		return hashdeep.FormatStatus(e.status, h.PathPrefix+e.path) + "\n"
+	}
+
+	return formatEntry(e.size, e.hashes, h.Algorithms, h.PathPrefix+e.path)
+}
+
+func formatEntry(size int64, hashes map[string]string, algorithms []string, path string) string {
+	var sb strings.Builder
+	sb.WriteString(strconv.FormatInt(size, 10))
+	for _, algorithm := range algorithms {
+		sb.WriteString(",")
+		sb.WriteString(hashes[algorithm])
+	}
+	sb.WriteString("," + hashdeep.QuoteFilename(path) + "\n")
+
+	return sb.String()
+}
+
+// Records a written entry in the checkpoint, syncing periodically
+func (h *HashdeepOutputFile) completed(e *HashdeepEntry) error {
+	h.checkpoint.complete(e.name)
+	h.unsynced++
+	if h.unsynced >= syncEntries || time.Since(h.lastSync) >= syncInterval {
+		return h.sync()
+	}
+
 	return nil
 }
 
-func (h *HashdeepOutputFile) Close() error {
+func (h *HashdeepOutputFile) write(s string) error {
+	n, err := h.writer.WriteString(s)
+	h.offset += int64(n)
+
+	return err
+}
+
+// Flushes the output file and records the progress in the checkpoint. Every
+// file is committed to disk before the record that refers to its offset, so
+// a crash never leaves a record pointing past the end of a file.
+func (h *HashdeepOutputFile) sync() error {
 	if err := h.writer.Flush(); err != nil {
 		return errors.Wrap(err, "could not flush output writer")
 	}
+	if err := h.file.Sync(); err != nil {
+		return errors.Wrapf(err, "could not sync results file '%s'", h.OutputFile)
+	}
+
+	var stateOffset int64
+	if h.state != nil {
+		if err := h.state.flush(); err != nil {
+			return errors.Wrap(err, "could not flush state writer")
+		}
+		stateOffset = h.state.offset
+	}
+
+	var deletedOffset int64
+	if h.deleted != nil {
+		if err := h.deleted.flush(); err != nil {
+			return errors.Wrap(err, "could not flush writer of deleted blobs")
+		}
+		deletedOffset = h.deleted.offset
+	}
+
+	if err := h.checkpoint.sync(h.offset, stateOffset, deletedOffset); err != nil {
+		return err
+	}
+
+	h.unsynced = 0
+	h.lastSync = time.Now()
+
+	return nil
+}
+
+func (h *HashdeepOutputFile) Close() error {
+	if err := h.sync(); err != nil {
+		return err
+	}
 
 	if err := h.file.Close(); err != nil {
 		return errors.Wrapf(err, "could not close results file '%s'", h.OutputFile)
 	}
 
+	if h.state != nil {
+		if err := h.state.close(); err != nil {
+			return errors.Wrapf(err, "could not close state file '%s'", h.state.path)
+		}
+	}
+
+	if h.deleted != nil {
+		if err := h.deleted.close(); err != nil {
+			return errors.Wrapf(err, "could not close results file '%s'", h.deleted.path)
+		}
+	}
+
+	if err := h.checkpoint.close(); err != nil {
+		return errors.Wrap(err, "could not close checkpoint")
+	}
+
 	log.Info("flushed and closed results file")
 	return nil
 }
 
-func (h *HashdeepOutputFile) checkDirectoryExists() error {
-	directory := filepath.Dir(h.OutputFile)
+// Creates a new output file along with its directory, refusing to overwrite existing files
+func createOutputFile(path string) (*os.File, error) {
+	if err := checkDirectoryExists(path); err != nil {
+		return nil, err
+	}
+
+	return os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0755)
+}
+
+func checkDirectoryExists(path string) error {
+	directory := filepath.Dir(path)
 	if _, err := os.Stat(directory); err != nil {
 		if os.IsNotExist(err) {
 			log.Infof("directory %s doesn't exist, creating", directory)
@@ -117,3 +385,61 @@ func (h *HashdeepOutputFile) checkDirectoryExists() error {
 
 	return nil
 }
+
+// A file that is only appended to, keeping track of its size
+type appendFile struct {
+	path   string
+	file   *os.File
+	writer *bufio.Writer
+	offset int64
+}
+
+func createAppendFile(path string) (*appendFile, error) {
+	file, err := createOutputFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &appendFile{path: path, file: file, writer: bufio.NewWriter(file)}, nil
+}
+
+// Opens the file of an interrupted run, discarding anything after offset
+func reopenAppendFile(path string, offset int64) (*appendFile, error) {
+	file, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := file.Truncate(offset); err != nil {
+		return nil, err
+	}
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	return &appendFile{path: path, file: file, writer: bufio.NewWriter(file), offset: offset}, nil
+}
+
+func (f *appendFile) write(s string) error {
+	n, err := f.writer.WriteString(s)
+	f.offset += int64(n)
+
+	return err
+}
+
+// Writes the buffered data and commits it to disk
+func (f *appendFile) flush() error {
+	if err := f.writer.Flush(); err != nil {
+		return err
+	}
+
+	return f.file.Sync()
+}
+
+func (f *appendFile) close() error {
+	if err := f.flush(); err != nil {
+		return err
+	}
+
+	return f.file.Close()
+}
@@ -0,0 +1,305 @@
+/*
+Copyright © 2019 Even Holthe
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package hashdeep
+
+import (
+	"bufio"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// Magic is the first line of every hashdeep file.
+	Magic         = "%%%% HASHDEEP-1.0"
+	columnsPrefix = "%%%% "
+	commentPrefix = "##"
+
+	ColumnSize     = "size"
+	ColumnFilename = "filename"
+
+	maxLineLength = 1024 * 1024
+)
+
+// Entry is a single file in a hashdeep file.
+type Entry struct {
+	Size int64
+	// Hex encoded digests keyed by algorithm name as declared in the header, e.g. "md5" or "sha256"
+	Hashes map[string]string
+	Path   string
+	// Set instead of the size and digests for a file that was not hashed, see Reader.Statuses
+	Status string
+}
+
+// Reader reads entries from a hashdeep file, as produced by hashdeep itself or by this tool.
+//
+// A file consists of the HASHDEEP-1.0 header, a column declaration such as
+// "%%%% size,md5,sha256,filename", optional "##" comment lines and one entry
+// per line. Concatenated files that repeat the header are supported, in which
+// case the latest column declaration applies to the following entries.
+type Reader struct {
+	// Return the "## <status>: <path>" lines this tool writes for files that
+	// were not hashed as entries with a Status, instead of skipping them
+	Statuses bool
+
+	scanner    *bufio.Scanner
+	line       int
+	columns    []string
+	algorithms []string
+	// Set when a header has been read, but not yet its column declaration
+	awaitingColumns bool
+}
+
+func NewReader(r io.Reader) *Reader {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxLineLength)
+
+	return &Reader{scanner: scanner}
+}
+
+// Columns returns the column declaration in effect, reading the header if needed.
+func (r *Reader) Columns() ([]string, error) {
+	if r.columns == nil {
+		if err := r.readHeader(); err != nil {
+			return nil, err
+		}
+	}
+
+	return r.columns, nil
+}
+
+// Algorithms returns the hash algorithms in effect, in the order they are declared.
+func (r *Reader) Algorithms() ([]string, error) {
+	if _, err := r.Columns(); err != nil {
+		return nil, err
+	}
+
+	return r.algorithms, nil
+}
+
+// Line returns the line number of the most recently read line.
+func (r *Reader) Line() int {
+	return r.line
+}
+
+// Read returns the next entry, or io.EOF when there are no more entries.
+func (r *Reader) Read() (*Entry, error) {
+	if _, err := r.Columns(); err != nil {
+		return nil, err
+	}
+
+	for {
+		line, err := r.nextLine()
+		if err != nil {
+			return nil, err
+		}
+
+		switch {
+		case r.awaitingColumns:
+			if err := r.parseColumns(line); err != nil {
+				return nil, err
+			}
+		case line == Magic:
+			r.awaitingColumns = true
+		case line == "" || strings.HasPrefix(line, commentPrefix):
+			if entry := parseStatus(line); r.Statuses && entry != nil {
+				return entry, nil
+			}
+			continue
+		default:
+			entry, err := r.parseEntry(line)
+			if err != nil {
+				return nil, errors.Wrapf(err, "line %d", r.line)
+			}
+
+			return entry, nil
+		}
+	}
+}
+
+func (r *Reader) readHeader() error {
+	line, err := r.nextLine()
+	if err == io.EOF {
+		return errors.New("empty file, expected hashdeep header")
+	}
+	if err != nil {
+		return err
+	}
+
+	if line != Magic {
+		return errors.Errorf("not a hashdeep file, expected header '%s'", Magic)
+	}
+
+	line, err = r.nextLine()
+	if err == io.EOF {
+		return errors.New("missing column declaration")
+	}
+	if err != nil {
+		return err
+	}
+
+	return r.parseColumns(line)
+}
+
+func (r *Reader) nextLine() (string, error) {
+	if !r.scanner.Scan() {
+		if err := r.scanner.Err(); err != nil {
+			return "", errors.Wrapf(err, "could not read line %d", r.line+1)
+		}
+
+		return "", io.EOF
+	}
+	r.line++
+
+	return strings.TrimRight(r.scanner.Text(), "\r"), nil
+}
+
+func (r *Reader) parseColumns(line string) error {
+	if !strings.HasPrefix(line, columnsPrefix) {
+		return errors.Errorf("line %d: expected column declaration", r.line)
+	}
+
+	columns := strings.Split(strings.TrimPrefix(line, columnsPrefix), ",")
+	algorithms := make([]string, 0, len(columns))
+	hasSize := false
+
+	for i, column := range columns {
+		column = strings.ToLower(strings.TrimSpace(column))
+		columns[i] = column
+
+		switch column {
+		case "":
+			return errors.Errorf("line %d: empty column name", r.line)
+		case ColumnSize:
+			hasSize = true
+		case ColumnFilename:
+			if i != len(columns)-1 {
+				return errors.Errorf("line %d: %s must be the last column", r.line, ColumnFilename)
+			}
+		default:
+			algorithms = append(algorithms, column)
+		}
+	}
+
+	if !hasSize {
+		return errors.Errorf("line %d: missing %s column", r.line, ColumnSize)
+	}
+	if columns[len(columns)-1] != ColumnFilename {
+		return errors.Errorf("line %d: missing %s column", r.line, ColumnFilename)
+	}
+	if len(algorithms) == 0 {
+		return errors.Errorf("line %d: no hash algorithms declared", r.line)
+	}
+
+	r.columns = columns
+	r.algorithms = algorithms
+	r.awaitingColumns = false
+
+	return nil
+}
+
+func (r *Reader) parseEntry(line string) (*Entry, error) {
+	// The filename is always the last column and may itself contain commas
+	values := strings.SplitN(line, ",", len(r.columns))
+	if len(values) != len(r.columns) {
+		return nil, errors.Errorf("expected %d columns, got %d", len(r.columns), len(values))
+	}
+
+	entry := &Entry{Hashes: make(map[string]string, len(r.algorithms))}
+	for i, column := range r.columns {
+		switch column {
+		case ColumnSize:
+			size, err := strconv.ParseInt(values[i], 10, 64)
+			if err != nil {
+				return nil, errors.Errorf("invalid size '%s'", values[i])
+			}
+			entry.Size = size
+		case ColumnFilename:
+			path, err := unquoteFilename(values[i])
+			if err != nil {
+				return nil, err
+			}
+			entry.Path = path
+		default:
+			entry.Hashes[column] = strings.ToLower(values[i])
+		}
+	}
+
+	return entry, nil
+}
+
+// FormatStatus formats a file that was not hashed as a comment, which hashdeep ignores.
+func FormatStatus(status string, path string) string {
+	return commentPrefix + " " + status + ": " + path
+}
+
+// Parses a comment written by FormatStatus, returning nil for any other comment
+func parseStatus(line string) *Entry {
+	status, path, found := strings.Cut(strings.TrimPrefix(line, commentPrefix+" "), ": ")
+	// Header comments such as "## Invoked from: ..." have spaces before the colon
+	if !strings.HasPrefix(line, commentPrefix+" ") || !found || status == "" || strings.ContainsAny(status, " \t") {
+		return nil
+	}
+
+	return &Entry{Path: path, Status: status}
+}
+
+// QuoteFilename quotes a filename that would otherwise be unquoted when read,
+// because it starts and ends with a double quote.
+func QuoteFilename(path string) string {
+	if len(path) < 2 || path[0] != '"' || path[len(path)-1] != '"' {
+		return path
+	}
+
+	escaped := strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(path)
+
+	return `"` + escaped + `"`
+}
+
+// Filenames wrapped in double quotes may escape quotes either CSV style ("")
+// or with a backslash (\"), and backslashes as \\. Any other backslash is
+// kept as it is, so Windows paths such as "C:\new\temp" are preserved.
+func unquoteFilename(value string) (string, error) {
+	if len(value) < 2 || value[0] != '"' || value[len(value)-1] != '"' {
+		return value, nil
+	}
+
+	var (
+		quoted = value[1 : len(value)-1]
+		sb     strings.Builder
+	)
+	sb.Grow(len(quoted))
+
+	for i := 0; i < len(quoted); i++ {
+		c := quoted[i]
+		switch {
+		case c == '"' && i+1 < len(quoted) && quoted[i+1] == '"':
+			sb.WriteByte('"')
+			i++
+		case c == '\\' && i+1 < len(quoted) && (quoted[i+1] == '\\' || quoted[i+1] == '"'):
+			sb.WriteByte(quoted[i+1])
+			i++
+		case c == '"':
+			return "", errors.Errorf("unescaped quote in filename %s", value)
+		default:
+			sb.WriteByte(c)
+		}
+	}
+
+	return sb.String(), nil
+}
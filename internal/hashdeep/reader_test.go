@@ -0,0 +1,172 @@
+/*
+Copyright © 2019 Even Holthe
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package hashdeep
+
+import (
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestUnquoteFilename(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		want    string
+		wantErr bool
+	}{
+		{name: "unquoted", value: `dir/file.txt`, want: `dir/file.txt`},
+		{name: "unquoted with quotes inside", value: `a"b`, want: `a"b`},
+		{name: "quoted", value: `"dir/file.txt"`, want: `dir/file.txt`},
+		{name: "empty quoted", value: `""`, want: ``},
+		{name: "csv style quote", value: `"say ""hi"""`, want: `say "hi"`},
+		{name: "backslash quote", value: `"say \"hi\""`, want: `say "hi"`},
+		{name: "escaped backslash", value: `"a\\b"`, want: `a\b`},
+		{name: "windows path", value: `"C:\new\temp"`, want: `C:\new\temp`},
+		{name: "windows path with tab and return", value: `"C:\tmp\reports"`, want: `C:\tmp\reports`},
+		{name: "trailing backslash", value: `"C:\dir\"`, want: `C:\dir\`},
+		{name: "unescaped quote", value: `"a"b"`, wantErr: true},
+		{name: "single quote character", value: `"`, want: `"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := unquoteFilename(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("unquoteFilename(%s) error = %v, wantErr %v", tt.value, err, tt.wantErr)
+			}
+			if !tt.wantErr && got != tt.want {
+				t.Errorf("unquoteFilename(%s) = %q, want %q", tt.value, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestQuoteFilename(t *testing.T) {
+	for _, path := range []string{`plain`, `a"b`, `"quoted"`, `"C:\dir\"`, `"say ""hi"""`, `""`, `"`} {
+		t.Run(path, func(t *testing.T) {
+			got, err := unquoteFilename(QuoteFilename(path))
+			if err != nil {
+				t.Fatalf("unquoteFilename(QuoteFilename(%s)): %v", path, err)
+			}
+			if got != path {
+				t.Errorf("unquoteFilename(QuoteFilename(%s)) = %s", path, got)
+			}
+		})
+	}
+}
+
+func TestReader(t *testing.T) {
+	tests := []struct {
+		name       string
+		input      string
+		statuses   bool
+		want       []Entry
+		algorithms []string
+		wantErr    string
+	}{
+		{
+			name: "hashdeep output",
+			input: "%%%% HASHDEEP-1.0\n" +
+				"%%%% size,md5,sha256,filename\n" +
+				"## Invoked from: /home/user\n" +
+				"## $ hashdeep -r -c md5,sha256 data\n" +
+				"##\n" +
+				"5,5D41402ABC4B2A76B9719D911017C592,abc,data/hello.txt\n" +
+				"\n" +
+				"0,d41d8cd98f00b204e9800998ecf8427e,def,data/a,b,c.txt\n",
+			algorithms: []string{"md5", "sha256"},
+			want: []Entry{
+				{Size: 5, Hashes: map[string]string{"md5": "5d41402abc4b2a76b9719d911017c592", "sha256": "abc"}, Path: "data/hello.txt"},
+				{Size: 0, Hashes: map[string]string{"md5": "d41d8cd98f00b204e9800998ecf8427e", "sha256": "def"}, Path: "data/a,b,c.txt"},
+			},
+		},
+		{
+			name:       "windows line endings and quoted filename",
+			input:      "%%%% HASHDEEP-1.0\r\n%%%% size,md5,filename\r\n1,aa,\"C:\\new\\temp\"\r\n",
+			algorithms: []string{"md5"},
+			want:       []Entry{{Size: 1, Hashes: map[string]string{"md5": "aa"}, Path: `C:\new\temp`}},
+		},
+		{
+			name: "concatenated files",
+			input: "%%%% HASHDEEP-1.0\n%%%% size,md5,filename\n1,aa,one\n" +
+				"%%%% HASHDEEP-1.0\n%%%% size,sha1,filename\n2,bb,two\n",
+			algorithms: []string{"sha1"},
+			want: []Entry{
+				{Size: 1, Hashes: map[string]string{"md5": "aa"}, Path: "one"},
+				{Size: 2, Hashes: map[string]string{"sha1": "bb"}, Path: "two"},
+			},
+		},
+		{
+			name:       "statuses skipped",
+			input:      "%%%% HASHDEEP-1.0\n%%%% size,md5,filename\n## Invoked from: /home/user\n##\n## archived: a\n1,aa,b\n",
+			algorithms: []string{"md5"},
+			want:       []Entry{{Size: 1, Hashes: map[string]string{"md5": "aa"}, Path: "b"}},
+		},
+		{
+			name:       "statuses returned",
+			input:      "%%%% HASHDEEP-1.0\n%%%% size,md5,filename\n## Invoked from: /home/user\n## $ az-blob-hashdeep generate\n##\n## archived: a: b\n1,aa,b\n## rehydrating: c\n",
+			statuses:   true,
+			algorithms: []string{"md5"},
+			want: []Entry{
+				{Path: "a: b", Status: "archived"},
+				{Size: 1, Hashes: map[string]string{"md5": "aa"}, Path: "b"},
+				{Path: "c", Status: "rehydrating"},
+			},
+		},
+		{name: "empty file", input: "", wantErr: "empty file"},
+		{name: "not hashdeep", input: "size,md5,filename\n", wantErr: "not a hashdeep file"},
+		{name: "missing columns", input: "%%%% HASHDEEP-1.0\n", wantErr: "missing column declaration"},
+		{name: "no size column", input: "%%%% HASHDEEP-1.0\n%%%% md5,filename\n", wantErr: "missing size column"},
+		{name: "filename not last", input: "%%%% HASHDEEP-1.0\n%%%% size,filename,md5\n", wantErr: "must be the last column"},
+		{name: "no algorithms", input: "%%%% HASHDEEP-1.0\n%%%% size,filename\n", wantErr: "no hash algorithms"},
+		{name: "invalid size", input: "%%%% HASHDEEP-1.0\n%%%% size,md5,filename\nx,aa,f\n", wantErr: "line 3: invalid size"},
+		{name: "too few columns", input: "%%%% HASHDEEP-1.0\n%%%% size,md5,filename\n1,aa\n", wantErr: "expected 3 columns"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewReader(strings.NewReader(tt.input))
+			r.Statuses = tt.statuses
+
+			var got []Entry
+			for {
+				entry, err := r.Read()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					if tt.wantErr == "" || !strings.Contains(err.Error(), tt.wantErr) {
+						t.Fatalf("Read() error = %v, want %q", err, tt.wantErr)
+					}
+					return
+				}
+				got = append(got, *entry)
+			}
+
+			if tt.wantErr != "" {
+				t.Fatalf("Read() succeeded, want error %q", tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Read() = %+v, want %+v", got, tt.want)
+			}
+			if algorithms, _ := r.Algorithms(); !reflect.DeepEqual(algorithms, tt.algorithms) {
+				t.Errorf("Algorithms() = %v, want %v", algorithms, tt.algorithms)
+			}
+		})
+	}
+}
@@ -0,0 +1,191 @@
+/*
+Copyright © 2019 Even Holthe
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package internal
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// Returns the lines of a hashdeep file that are not part of its header, in order
+func readEntryLines(t *testing.T, path string) []string {
+	t.Helper()
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	var lines []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if line := scanner.Text(); !strings.HasPrefix(line, "%%%%") && !strings.HasPrefix(line, "## ") && line != "##" {
+			lines = append(lines, line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	return lines
+}
+
+// Returns the names recorded in a state file, in order
+func readStateNames(t *testing.T, path string) []string {
+	t.Helper()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		name := strings.SplitN(strings.TrimPrefix(line, `{"name":"`), `"`, 2)[0]
+		names = append(names, name)
+	}
+
+	return names
+}
+
+func fileSize(t *testing.T, path string) int64 {
+	t.Helper()
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return info.Size()
+}
+
+func TestHashdeepOutputFileResume(t *testing.T) {
+	output := filepath.Join(t.TempDir(), "out.hashdeep")
+	entry := func(name string, deleted bool) *HashdeepEntry {
+		return &HashdeepEntry{size: 1, hashes: map[string]string{"md5": "0cc175b9c0f1b6a831c399e269772661"}, path: name, name: name, deleted: deleted}
+	}
+
+	// The interrupted run lists two pages, completes the first one and part of
+	// the second one, and is killed after writing more than it recorded
+	h := &HashdeepOutputFile{OutputFile: output, Algorithms: []string{"md5"}, WriteState: true, Deleted: true}
+	if err := h.Open(); err != nil {
+		t.Fatal(err)
+	}
+	h.Checkpoint().listed("", "", "", "a", []string{"a", "b"})
+	h.Checkpoint().listed("", "", "c", "c", []string{"c", "d", "e", "f"})
+	for _, e := range []*HashdeepEntry{entry("a", false), entry("b", true), entry("d", false), entry("e", true)} {
+		if err := h.WriteEntry(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := h.sync(); err != nil {
+		t.Fatal(err)
+	}
+	offset, stateOffset, deletedOffset := h.offset, h.state.offset, h.deleted.offset
+
+	for _, e := range []*HashdeepEntry{entry("c", false), entry("f", true)} {
+		if err := h.WriteEntry(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, err := range []error{h.writer.Flush(), h.state.flush(), h.deleted.flush()} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := h.checkpoint.file.WriteString(`{"offset":1`); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range []*os.File{h.file, h.state.file, h.deleted.file, h.checkpoint.file} {
+		_ = f.Close()
+	}
+
+	r := &HashdeepOutputFile{OutputFile: output, Algorithms: []string{"md5"}, WriteState: true, Deleted: true, Resume: true}
+	if err := r.Open(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, file := range []struct {
+		path string
+		want int64
+	}{
+		{output, offset},
+		{output + stateSuffix, stateOffset},
+		{output + deletedSuffix, deletedOffset},
+	} {
+		if got := fileSize(t, file.path); got != file.want {
+			t.Errorf("%s was rolled back to %d bytes, want %d", filepath.Base(file.path), got, file.want)
+		}
+	}
+
+	progress := r.Checkpoint()
+	if progress.resumeMarker() != "c" {
+		t.Errorf("resumeMarker() = %q, want c", progress.resumeMarker())
+	}
+	var skipped []string
+	for _, name := range []string{"a", "b", "c", "d", "e", "f"} {
+		if progress.skip(name) {
+			skipped = append(skipped, name)
+		}
+	}
+	// Names before the resume page are not listed again, so only d and e need skipping
+	if want := []string{"d", "e"}; !reflect.DeepEqual(skipped, want) {
+		t.Errorf("skipped %v, want %v", skipped, want)
+	}
+
+	// The resumed run lists the second page again, without the skipped names
+	progress.listed("", "", "c", "c", []string{"c", "f"})
+	progress.finishListing()
+	for _, e := range []*HashdeepEntry{entry("f", true), entry("c", false)} {
+		if err := r.WriteEntry(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !r.Finished() {
+		t.Error("resumed run is not finished")
+	}
+
+	line := func(name string) string {
+		return strings.TrimSuffix(formatEntry(1, map[string]string{"md5": "0cc175b9c0f1b6a831c399e269772661"}, []string{"md5"}, name), "\n")
+	}
+	for _, file := range []struct {
+		path string
+		got  []string
+		want []string
+	}{
+		{output, readEntryLines(t, output), []string{line("a"), line("d"), line("c")}},
+		{output + deletedSuffix, readEntryLines(t, output+deletedSuffix), []string{line("b"), line("e"), line("f")}},
+		{output + stateSuffix, readStateNames(t, output+stateSuffix), []string{"a", "d", "c"}},
+	} {
+		sort.Strings(file.got)
+		sort.Strings(file.want)
+		if !reflect.DeepEqual(file.got, file.want) {
+			t.Errorf("%s = %v, want %v", filepath.Base(file.path), file.got, file.want)
+		}
+	}
+	if _, err := os.Stat(output + checkpointSuffix); !os.IsNotExist(err) {
+		t.Errorf("checkpoint of a finished run was not removed: %v", err)
+	}
+}
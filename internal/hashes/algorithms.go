@@ -0,0 +1,130 @@
+/*
+Copyright © 2019 Even Holthe
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package hashes
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"strings"
+
+	"github.com/jzelinskie/whirlpool"
+)
+
+const (
+	MD5       = "md5"
+	SHA1      = "sha1"
+	SHA256    = "sha256"
+	SHA512    = "sha512"
+	Tiger     = "tiger"
+	Whirlpool = "whirlpool"
+)
+
+// Supported algorithms, in the column order used by hashdeep
+var algorithms = []struct {
+	name string
+	new  func() hash.Hash
+}{
+	{MD5, md5.New},
+	{SHA1, sha1.New},
+	{SHA256, sha256.New},
+	{SHA512, sha512.New},
+	{Whirlpool, whirlpool.New},
+}
+
+// ParseAlgorithms validates a list of algorithm names and returns them de-duplicated in hashdeep column order.
+func ParseAlgorithms(names []string) ([]string, error) {
+	requested := make(map[string]bool, len(names))
+	for _, name := range names {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		if name == Tiger {
+			return nil, fmt.Errorf("the %s algorithm is not supported", Tiger)
+		}
+		if newHash(name) == nil {
+			return nil, fmt.Errorf("unknown algorithm '%s'", name)
+		}
+		requested[name] = true
+	}
+
+	if len(requested) == 0 {
+		return nil, fmt.Errorf("at least one algorithm must be specified")
+	}
+
+	ordered := make([]string, 0, len(requested))
+	for _, a := range algorithms {
+		if requested[a.name] {
+			ordered = append(ordered, a.name)
+		}
+	}
+
+	return ordered, nil
+}
+
+func newHash(name string) hash.Hash {
+	for _, a := range algorithms {
+		if a.name == name {
+			return a.new()
+		}
+	}
+
+	return nil
+}
+
+// MultiHash fans a single stream into one hash.Hash per algorithm.
+type MultiHash struct {
+	hashes map[string]hash.Hash
+	writer io.Writer
+	n      int64
+}
+
+func NewMultiHash(algorithms []string) *MultiHash {
+	m := &MultiHash{hashes: make(map[string]hash.Hash, len(algorithms))}
+
+	writers := make([]io.Writer, 0, len(algorithms))
+	for _, algorithm := range algorithms {
+		h := newHash(algorithm)
+		m.hashes[algorithm] = h
+		writers = append(writers, h)
+	}
+	m.writer = io.MultiWriter(writers...)
+
+	return m
+}
+
+func (m *MultiHash) Write(p []byte) (int, error) {
+	n, err := m.writer.Write(p)
+	m.n += int64(n)
+
+	return n, err
+}
+
+// Digests returns the digests of everything written so far.
+func (m *MultiHash) Digests() *Digests {
+	values := make(map[string]string, len(m.hashes))
+	for algorithm, h := range m.hashes {
+		values[algorithm] = hex.EncodeToString(h.Sum(nil))
+	}
+
+	return &Digests{Values: values, BytesRead: m.n}
+}
@@ -0,0 +1,131 @@
+/*
+Copyright © 2019 Even Holthe
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package hashes
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob"
+)
+
+// How Archive tier blobs, which cannot be downloaded, are handled
+const (
+	// Skip them
+	ArchiveSkip = "skip"
+	// Use the MD5 from blob metadata when only md5 is requested, otherwise skip them
+	ArchiveMetadata = "metadata"
+	// Request rehydration to an online tier and skip them until it completes
+	ArchiveRehydrate = "rehydrate"
+)
+
+// Statuses of blobs that could not be hashed
+const (
+	StatusArchived    = "archived"
+	StatusRehydrating = "rehydrating"
+	StatusDeleted     = "deleted"
+)
+
+// SkippedError is returned for blobs that cannot be hashed in their current state.
+type SkippedError struct {
+	Name   string
+	Status string
+}
+
+func (e *SkippedError) Error() string {
+	return fmt.Sprintf("%s is %s", e.Name, e.Status)
+}
+
+// IsOffline reports whether a blob is in the Archive tier, including while it is being rehydrated.
+func IsOffline(item azblob.BlobItemInternal) bool {
+	return item.Properties.AccessTier != nil && *item.Properties.AccessTier == azblob.AccessTierArchive
+}
+
+// Handles a blob that cannot be downloaded according to the Archive setting
+func (d *DownloadAndCalculateHasher) offline(ctx context.Context, item azblob.BlobItemInternal) (*Digests, error) {
+	if item.Properties.ArchiveStatus != nil {
+		return nil, &SkippedError{Name: *item.Name, Status: StatusRehydrating}
+	}
+
+	switch d.Archive {
+	case ArchiveMetadata:
+		if digests, ok := d.metadata(item); ok {
+			return digests, nil
+		}
+	case ArchiveRehydrate:
+		blob := blobClient(d.Client, item)
+		options := &azblob.SetTierOptions{RehydratePriority: &d.RehydratePriority}
+		if _, err := blob.SetTier(ctx, d.RehydrateTier, options); err != nil {
+			return nil, fmt.Errorf("could not rehydrate %s: %w", *item.Name, err)
+		}
+		logger.Infof("requested rehydration of %s to %s", *item.Name, d.RehydrateTier)
+
+		return nil, &SkippedError{Name: *item.Name, Status: StatusRehydrating}
+	}
+
+	return nil, &SkippedError{Name: *item.Name, Status: StatusArchived}
+}
+
+// Refresh fetches the current tier of a blob, reporting whether it can be downloaded.
+func (d *DownloadAndCalculateHasher) Refresh(ctx context.Context, item *azblob.BlobItemInternal) (bool, error) {
+	resp, err := blobClient(d.Client, *item).GetProperties(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+
+	if resp.AccessTier != nil {
+		tier := azblob.AccessTier(*resp.AccessTier)
+		item.Properties.AccessTier = &tier
+	}
+	item.Properties.ArchiveStatus = nil
+	if resp.ArchiveStatus != nil {
+		status := azblob.ArchiveStatus(*resp.ArchiveStatus)
+		item.Properties.ArchiveStatus = &status
+	}
+	if resp.ETag != nil {
+		// Unlike in listings, the header value is quoted
+		etag := strings.Trim(*resp.ETag, `"`)
+		item.Properties.Etag = &etag
+	}
+	if resp.ContentLength != nil {
+		item.Properties.ContentLength = resp.ContentLength
+	}
+
+	return !IsOffline(*item), nil
+}
+
+// Handles a soft-deleted blob, which cannot be downloaded without undeleting it
+func (d *DownloadAndCalculateHasher) deleted(item azblob.BlobItemInternal) (*Digests, error) {
+	if digests, ok := d.metadata(item); ok {
+		return digests, nil
+	}
+
+	return nil, &SkippedError{Name: BlobID(item), Status: StatusDeleted}
+}
+
+// Returns the MD5 from blob metadata when it is the only requested algorithm
+func (d *DownloadAndCalculateHasher) metadata(item azblob.BlobItemInternal) (*Digests, bool) {
+	if len(item.Properties.ContentMD5) == 0 || len(d.Algorithms) != 1 || d.Algorithms[0] != MD5 {
+		return nil, false
+	}
+
+	return &Digests{
+		Values:    map[string]string{MD5: hex.EncodeToString(item.Properties.ContentMD5)},
+		BytesRead: NotRead,
+	}, true
+}
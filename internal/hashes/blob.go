@@ -0,0 +1,60 @@
+/*
+Copyright © 2019 Even Holthe
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package hashes
+
+import "github.com/Azure/azure-sdk-for-go/sdk/storage/azblob"
+
+// BlobID identifies a blob, snapshot or previous version in a listing. It is
+// the blob name, followed by ?snapshot=<timestamp> for snapshots and
+// ?versionid=<id> for previous versions, like in their URLs.
+func BlobID(item azblob.BlobItemInternal) string {
+	switch {
+	case isSnapshot(item):
+		return *item.Name + "?snapshot=" + *item.Snapshot
+	case isPreviousVersion(item):
+		return *item.Name + "?versionid=" + *item.VersionID
+	}
+
+	return *item.Name
+}
+
+// IsDeleted reports whether a blob is soft-deleted.
+func IsDeleted(item azblob.BlobItemInternal) bool {
+	return item.Deleted != nil && *item.Deleted
+}
+
+func isSnapshot(item azblob.BlobItemInternal) bool {
+	return item.Snapshot != nil && *item.Snapshot != ""
+}
+
+// The current version is addressed by the blob name alone
+func isPreviousVersion(item azblob.BlobItemInternal) bool {
+	return item.VersionID != nil && *item.VersionID != "" && (item.IsCurrentVersion == nil || !*item.IsCurrentVersion)
+}
+
+// Returns a client for the blob, snapshot or version in a listing
+func blobClient(container *azblob.ContainerClient, item azblob.BlobItemInternal) azblob.BlobClient {
+	blob := container.NewBlobClient(*item.Name)
+
+	switch {
+	case isSnapshot(item):
+		return blob.WithSnapshot(*item.Snapshot)
+	case isPreviousVersion(item):
+		return blob.WithVersionID(*item.VersionID).BlobClient
+	}
+
+	return blob
+}
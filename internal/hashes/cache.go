@@ -0,0 +1,157 @@
+/*
+Copyright © 2019 Even Holthe
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package hashes
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var cacheBucket = []byte("digests")
+
+// How long to wait for another process holding the cache
+const cacheLockTimeout = 10 * time.Second
+
+// Cache is a persistent store of calculated digests, shared between runs.
+//
+// Entries are keyed by endpoint, account, container and blob name, so that
+// accounts of the same name in different clouds or emulators never share
+// entries. They hold the digests calculated for a single ETag. A new ETag
+// replaces the entry, which keeps the cache from growing with every
+// modification of a blob.
+type Cache struct {
+	db     *bolt.DB
+	hits   uint64
+	misses uint64
+}
+
+type cacheEntry struct {
+	Etag    string            `json:"etag"`
+	Digests map[string]string `json:"digests"`
+}
+
+// CacheKey identifies a blob in the cache.
+type CacheKey struct {
+	// URL of the blob service
+	Endpoint  string
+	Account   string
+	Container string
+	Name      string
+}
+
+func (k CacheKey) bytes() []byte {
+	return []byte(strings.Join([]string{k.Endpoint, k.Account, k.Container, k.Name}, "\x00"))
+}
+
+// OpenCache opens or creates the cache database at path.
+func OpenCache(path string) (*Cache, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: cacheLockTimeout})
+	if err == bolt.ErrTimeout {
+		return nil, fmt.Errorf("cache '%s' is in use by another process", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not open cache '%s': %w", path, err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(cacheBucket)
+		return err
+	})
+	if err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("could not initialize cache '%s': %w", path, err)
+	}
+
+	return &Cache{db: db}, nil
+}
+
+// Get returns the digests of a blob when all algorithms were calculated for its current ETag.
+func (c *Cache) Get(key CacheKey, etag string, algorithms []string) (map[string]string, bool) {
+	entry, err := c.get(key)
+	if err != nil || entry == nil || entry.Etag != etag {
+		atomic.AddUint64(&c.misses, 1)
+		return nil, false
+	}
+
+	values := make(map[string]string, len(algorithms))
+	for _, algorithm := range algorithms {
+		value, ok := entry.Digests[algorithm]
+		if !ok {
+			atomic.AddUint64(&c.misses, 1)
+			return nil, false
+		}
+		values[algorithm] = value
+	}
+
+	atomic.AddUint64(&c.hits, 1)
+	return values, true
+}
+
+// Put stores the digests of a blob, keeping digests of other algorithms calculated for the same ETag.
+func (c *Cache) Put(key CacheKey, etag string, digests map[string]string) error {
+	// Batch coalesces the writes of concurrent workers into fewer transactions
+	return c.db.Batch(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(cacheBucket)
+
+		entry := &cacheEntry{Etag: etag, Digests: make(map[string]string, len(digests))}
+		if existing := bucket.Get(key.bytes()); existing != nil {
+			previous := &cacheEntry{}
+			if err := json.Unmarshal(existing, previous); err == nil && previous.Etag == etag {
+				entry.Digests = previous.Digests
+			}
+		}
+		for algorithm, value := range digests {
+			entry.Digests[algorithm] = value
+		}
+
+		value, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+
+		return bucket.Put(key.bytes(), value)
+	})
+}
+
+func (c *Cache) get(key CacheKey) (*cacheEntry, error) {
+	var entry *cacheEntry
+
+	err := c.db.View(func(tx *bolt.Tx) error {
+		value := tx.Bucket(cacheBucket).Get(key.bytes())
+		if value == nil {
+			return nil
+		}
+
+		entry = &cacheEntry{}
+		return json.Unmarshal(value, entry)
+	})
+
+	return entry, err
+}
+
+// Stats returns the number of lookups that were served from the cache and those that were not.
+func (c *Cache) Stats() (hits uint64, misses uint64) {
+	return atomic.LoadUint64(&c.hits), atomic.LoadUint64(&c.misses)
+}
+
+func (c *Cache) Close() error {
+	return c.db.Close()
+}
@@ -17,7 +17,7 @@ package hashes
 
 import (
 	"context"
-	"crypto/md5"
+	"errors"
 	"fmt"
 	"io"
 
@@ -26,28 +26,80 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
-var (
-	logger              = log.WithField("step", "stream_blob_to_hash")
-	downloadBlobOptions = &azblob.DownloadBlobOptions{
-		Offset:               pointy.Int64(0),
-		Count:                pointy.Int64(azblob.CountToEnd),
-		BlobAccessConditions: nil,
-	}
-)
+var logger = log.WithField("step", "stream_blob_to_hash")
 
-// Stream bytes to memory and perform MD5 hashing locally.
+// Stream bytes to memory and calculate every requested digest locally in a single pass.
 type DownloadAndCalculateHasher struct {
-	Client *azblob.ContainerClient
+	Client     *azblob.ContainerClient
+	Algorithms []string
+	// Optional, consulted before downloading. Endpoint, Account and Container identify the blobs in it.
+	Cache     *Cache
+	Endpoint  string
+	Account   string
+	Container string
+	// Handling of Archive tier blobs, see ArchiveSkip, ArchiveMetadata and ArchiveRehydrate
+	Archive           string
+	RehydrateTier     azblob.AccessTier
+	RehydratePriority azblob.RehydratePriority
 }
 
-func (d *DownloadAndCalculateHasher) Hash(ctx context.Context, item azblob.BlobItemInternal) (*string, error) {
-	url := d.Client.NewBlobClient(*item.Name)
-	resp, err := url.Download(ctx, downloadBlobOptions)
+func (d *DownloadAndCalculateHasher) Hash(ctx context.Context, item azblob.BlobItemInternal) (*Digests, error) {
+	var (
+		key  = CacheKey{Endpoint: d.Endpoint, Account: d.Account, Container: d.Container, Name: BlobID(item)}
+		etag string
+	)
+	if item.Properties.Etag != nil {
+		etag = *item.Properties.Etag
+	}
+
+	if d.Cache != nil && etag != "" {
+		if values, ok := d.Cache.Get(key, etag, d.Algorithms); ok {
+			return &Digests{Values: values, BytesRead: NotRead}, nil
+		}
+	}
+
+	if IsDeleted(item) {
+		return d.deleted(item)
+	}
+	if IsOffline(item) {
+		return d.offline(ctx, item)
+	}
+
+	digests, err := d.download(ctx, item, etag)
 	if err != nil {
 		return nil, err
 	}
 
-	h := md5.New()
+	if d.Cache != nil && etag != "" {
+		if err := d.Cache.Put(key, etag, digests.Values); err != nil {
+			logger.Warnf("could not cache digests of %s: %v", *item.Name, err)
+		}
+	}
+
+	return digests, nil
+}
+
+// Downloads the blob as it was listed. When it has changed since, the download
+// fails, so that digests of other content are neither written nor cached.
+func (d *DownloadAndCalculateHasher) download(ctx context.Context, item azblob.BlobItemInternal, etag string) (*Digests, error) {
+	options := &azblob.DownloadBlobOptions{
+		Offset: pointy.Int64(0),
+		Count:  pointy.Int64(azblob.CountToEnd),
+	}
+	if etag != "" {
+		options.BlobAccessConditions = &azblob.BlobAccessConditions{
+			ModifiedAccessConditions: &azblob.ModifiedAccessConditions{IfMatch: &etag},
+		}
+	}
+
+	url := blobClient(d.Client, item)
+	resp, err := url.Download(ctx, options)
+	if isConditionNotMet(err) {
+		return nil, fmt.Errorf("%s changed since it was listed: %w", *item.Name, err)
+	}
+	if err != nil {
+		return nil, err
+	}
 
 	blobStream := resp.Body(azblob.RetryReaderOptions{MaxRetryRequests: 5})
 	defer func(blobStream io.ReadCloser) {
@@ -56,10 +108,26 @@ func (d *DownloadAndCalculateHasher) Hash(ctx context.Context, item azblob.BlobI
 		}
 	}(blobStream)
 
+	h := NewMultiHash(d.Algorithms)
 	if _, err = io.Copy(h, blobStream); err != nil {
+		// Retries of an interrupted download are bound to the ETag of the first response
+		if isConditionNotMet(err) {
+			return nil, fmt.Errorf("%s changed while it was downloaded: %w", *item.Name, err)
+		}
 		logger.Warnf("could not download %s for local hash calculation", url.URL())
-		return nil, nil
+		return nil, err
 	}
 
-	return pointy.String(fmt.Sprintf("%x", h.Sum(nil))), nil
+	digests := h.Digests()
+	if expected := item.Properties.ContentLength; expected != nil && digests.BytesRead != *expected {
+		return nil, fmt.Errorf("truncated download of %s: read %d of %d bytes", *item.Name, digests.BytesRead, *expected)
+	}
+
+	return digests, nil
+}
+
+// Reports whether a request failed because of an access condition, i.e. the blob has a different ETag
+func isConditionNotMet(err error) bool {
+	var storageErr *azblob.StorageError
+	return errors.As(err, &storageErr) && storageErr.ErrorCode == azblob.StorageErrorCodeConditionNotMet
 }
@@ -0,0 +1,94 @@
+/*
+Copyright © 2019 Even Holthe
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package hashes
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob"
+	"github.com/openlyinc/pointy"
+)
+
+func TestDownloadAndCalculateHasherIfMatch(t *testing.T) {
+	const (
+		content = "hello"
+		current = `"0x2"`
+	)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-Match") != current {
+			w.Header().Set("x-ms-error-code", string(azblob.StorageErrorCodeConditionNotMet))
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return
+		}
+		w.Header().Set("ETag", current)
+		_, _ = w.Write([]byte(content))
+	}))
+	defer server.Close()
+
+	client, err := azblob.NewContainerClientWithNoCredential(server.URL+"/container", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache, err := OpenCache(filepath.Join(t.TempDir(), "cache.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cache.Close()
+
+	tests := []struct {
+		name    string
+		etag    string
+		want    string
+		wantErr string
+	}{
+		{name: "changed since listed", etag: `"0x1"`, wantErr: "blob changed since it was listed"},
+		{name: "unchanged", etag: current, want: "5d41402abc4b2a76b9719d911017c592"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			d := &DownloadAndCalculateHasher{Client: &client, Algorithms: []string{MD5}, Cache: cache, Container: "container"}
+			item := azblob.BlobItemInternal{
+				Name:       pointy.String("blob"),
+				Properties: &azblob.BlobPropertiesInternal{Etag: pointy.String(test.etag), ContentLength: pointy.Int64(int64(len(content)))},
+			}
+
+			digests, err := d.Hash(context.Background(), item)
+			cached, ok := cache.Get(CacheKey{Container: "container", Name: "blob"}, test.etag, []string{MD5})
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("Hash() error = %v, want %q", err, test.wantErr)
+				}
+				if ok {
+					t.Errorf("digests of a changed blob were cached: %v", cached)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if digests.Values[MD5] != test.want || cached[MD5] != test.want {
+				t.Errorf("Hash() = %v, cached %v, want %s", digests.Values, cached, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,67 @@
+/*
+Copyright © 2019 Even Holthe
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package hashes
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob"
+)
+
+// Read files below a local directory and calculate every requested digest in
+// a single pass. Item names are paths relative to Root with forward slashes.
+type FileHasher struct {
+	Root       string
+	Algorithms []string
+}
+
+func (f *FileHasher) Hash(ctx context.Context, item azblob.BlobItemInternal) (*Digests, error) {
+	file, err := os.Open(filepath.Join(f.Root, filepath.FromSlash(*item.Name)))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	h := NewMultiHash(f.Algorithms)
+	if _, err := io.Copy(h, &contextReader{ctx: ctx, r: file}); err != nil {
+		return nil, err
+	}
+
+	digests := h.Digests()
+	if expected := item.Properties.ContentLength; expected != nil && digests.BytesRead != *expected {
+		return nil, fmt.Errorf("%s changed while hashing: read %d of %d bytes", *item.Name, digests.BytesRead, *expected)
+	}
+
+	return digests, nil
+}
+
+// Stops reading once the context is done, so that hashing a large file can be cancelled
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c *contextReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	return c.r.Read(p)
+}
@@ -0,0 +1,73 @@
+/*
+Copyright © 2019 Even Holthe
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package hashes
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob"
+	"github.com/openlyinc/pointy"
+)
+
+func TestFileHasher(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "a"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "a", "b.txt"), []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	tests := []struct {
+		name    string
+		ctx     context.Context
+		size    int64
+		want    string
+		wantErr error
+	}{
+		{name: "file", ctx: context.Background(), size: 5, want: "5d41402abc4b2a76b9719d911017c592"},
+		{name: "changed size", ctx: context.Background(), size: 4},
+		{name: "cancelled", ctx: cancelled, size: 5, wantErr: context.Canceled},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f := &FileHasher{Root: dir, Algorithms: []string{MD5}}
+			item := azblob.BlobItemInternal{Name: pointy.String("a/b.txt"), Properties: &azblob.BlobPropertiesInternal{ContentLength: pointy.Int64(test.size)}}
+
+			digests, err := f.Hash(test.ctx, item)
+			if test.want == "" {
+				if err == nil || (test.wantErr != nil && !errors.Is(err, test.wantErr)) {
+					t.Fatalf("Hash() error = %v, want %v", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if digests.Values[MD5] != test.want {
+				t.Errorf("Hash() = %s, want %s", digests.Values[MD5], test.want)
+			}
+		})
+	}
+}
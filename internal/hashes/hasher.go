@@ -20,26 +20,45 @@ import (
 	"encoding/hex"
 
 	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob"
-	"github.com/openlyinc/pointy"
 )
 
+// BytesRead of hashers that never read the blob content
+const NotRead int64 = -1
+
+// Digests is the outcome of hashing a single blob.
+type Digests struct {
+	// Hex encoded digests keyed by algorithm name
+	Values map[string]string
+	// Number of content bytes actually read, or NotRead
+	BytesRead int64
+}
+
 type Hasher interface {
-	Hash(ctx context.Context, item azblob.BlobItemInternal) (*string, error)
+	Hash(ctx context.Context, item azblob.BlobItemInternal) (*Digests, error)
 }
 
 // Use the MD5 hash from blob metadata.
 type MetadataHasher struct {
 }
 
-func (m *MetadataHasher) Hash(_ context.Context, item azblob.BlobItemInternal) (*string, error) {
-	return pointy.String(hex.EncodeToString(item.Properties.ContentMD5)), nil
+func (m *MetadataHasher) Hash(_ context.Context, item azblob.BlobItemInternal) (*Digests, error) {
+	return &Digests{
+		Values:    map[string]string{MD5: hex.EncodeToString(item.Properties.ContentMD5)},
+		BytesRead: NotRead,
+	}, nil
 }
 
 // Used for development purposes
 type DummyHasher struct {
 	StaticValue string
+	Algorithms  []string
 }
 
-func (d *DummyHasher) Hash(_ context.Context, _ azblob.BlobItemInternal) (*string, error) {
-	return pointy.String(d.StaticValue), nil
+func (d *DummyHasher) Hash(_ context.Context, _ azblob.BlobItemInternal) (*Digests, error) {
+	values := make(map[string]string, len(d.Algorithms))
+	for _, algorithm := range d.Algorithms {
+		values[algorithm] = d.StaticValue
+	}
+
+	return &Digests{Values: values, BytesRead: NotRead}, nil
 }
@@ -0,0 +1,199 @@
+/*
+Copyright © 2019 Even Holthe
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package internal
+
+import (
+	"context"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/text/unicode/norm"
+)
+
+// Normalizes an output path to Unicode NFC, so that a name gives the same path
+// whether it was stored decomposed, e.g. by macOS, or composed
+func normalizePath(path string) string {
+	return norm.NFC.String(path)
+}
+
+// Walks the local directory of a source from marker and queues the regular
+// files below prefix matching the filter for hashing. Files are listed like
+// blobs, named by their path relative to the directory with forward slashes,
+// and in name order. A page of the walk is resumed from its first name, which
+// serves as its marker. Files and directories that are skipped are counted in
+// the source.
+func listFiles(ctx context.Context, s *source, prefix string, marker string, progress *checkpoint, hashJobs chan<- hashJob) error {
+	logger := log.WithField("phase", "local_directory_traversal")
+	if prefix != "" {
+		logger.Infof("listing files with prefix %s", prefix)
+	}
+	if marker != "" {
+		logger.Infof("resuming traversal from %s", marker)
+	}
+
+	var (
+		jobs   = make([]azblob.BlobItemInternal, 0, maxAzResults)
+		first  string
+		listed int32
+	)
+	queue := func() error {
+		if progress != nil {
+			names := make([]string, 0, len(jobs))
+			for _, job := range jobs {
+				names = append(names, s.id(job))
+			}
+			progress.listed(s.key, prefix, first, s.key+first, names)
+		}
+
+		for _, job := range jobs {
+			select {
+			case hashJobs <- hashJob{item: job, source: s}:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		jobs, listed = jobs[:0], 0
+
+		return nil
+	}
+
+	descend := func(dir string) bool {
+		dir += "/"
+		// Everything below a directory sorting before the marker was listed earlier
+		if dir < marker && !strings.HasPrefix(marker, dir) {
+			return false
+		}
+		return strings.HasPrefix(prefix, dir) || strings.HasPrefix(dir, prefix)
+	}
+
+	skip := func(name string, err error) {
+		// Directories are only read when accepted by descend, files count if they would have been listed
+		isFile := !strings.HasSuffix(name, "/")
+		if isFile && (name < marker || !strings.HasPrefix(name, prefix) || (s.config.filter != nil && !s.config.filter.matchesName(name))) {
+			return
+		}
+
+		logger.WithField("status", "skipped").Warnf("skipping %s: %v", name, err)
+		s.skipped++
+	}
+
+	err := walkFiles(s.config.Directory, "", descend, skip, func(name string, info fs.FileInfo) error {
+		if name < marker || !strings.HasPrefix(name, prefix) {
+			return nil
+		}
+		if listed == 0 {
+			first = name
+		}
+		listed++
+
+		item := fileItem(name, info)
+		if s.config.filter.matches(item) && (progress == nil || !progress.skip(s.id(item))) {
+			jobs = append(jobs, item)
+		}
+		if listed == maxAzResults {
+			return queue()
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if listed == 0 {
+		return nil
+	}
+
+	return queue()
+}
+
+// Calls fn with the regular files below dir in name order, descending only
+// into the directories accepted by descend. Unreadable directories and files,
+// and anything but regular files and directories, are passed to skip.
+// Symbolic links are not followed.
+func walkFiles(root string, dir string, descend func(dir string) bool, skip func(name string, err error), fn func(name string, info fs.FileInfo) error) error {
+	entries, err := os.ReadDir(filepath.Join(root, filepath.FromSlash(dir)))
+	if err != nil {
+		if dir == "" {
+			return err
+		}
+		skip(dir+"/", err)
+		return nil
+	}
+
+	// A directory sorts like the names of the files below it
+	sort.Slice(entries, func(i, j int) bool {
+		return entryName(entries[i]) < entryName(entries[j])
+	})
+
+	for _, entry := range entries {
+		name := entry.Name()
+		if dir != "" {
+			name = dir + "/" + name
+		}
+
+		if entry.IsDir() {
+			if descend(name) {
+				if err := walkFiles(root, name, descend, skip, fn); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		if !entry.Type().IsRegular() {
+			skip(name, errors.New("not a regular file"))
+			continue
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			skip(name, err)
+			continue
+		}
+		if err := fn(name, info); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func entryName(entry fs.DirEntry) string {
+	if entry.IsDir() {
+		return entry.Name() + "/"
+	}
+
+	return entry.Name()
+}
+
+// Describes a file like a listed blob, so that it is filtered and hashed the same way
+func fileItem(name string, info fs.FileInfo) azblob.BlobItemInternal {
+	size := info.Size()
+	modified := info.ModTime().UTC()
+
+	return azblob.BlobItemInternal{
+		Name: &name,
+		Properties: &azblob.BlobPropertiesInternal{
+			ContentLength: &size,
+			LastModified:  &modified,
+		},
+	}
+}
@@ -0,0 +1,145 @@
+/*
+Copyright © 2019 Even Holthe
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package internal
+
+import (
+	"context"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestWalkFiles(t *testing.T) {
+	tests := []struct {
+		name        string
+		files       []string
+		links       map[string]string
+		unreadable  []string
+		want        []string
+		wantSkipped []string
+	}{
+		{
+			// '-' and '.' sort before '/', '0' after it
+			name:  "directories sort like the names below them",
+			files: []string{"a0", "a/b", "a-c", "a.txt", "a/a/z"},
+			want:  []string{"a-c", "a.txt", "a/a/z", "a/b", "a0"},
+		},
+		{
+			name:        "symbolic links",
+			files:       []string{"a", "d/c"},
+			links:       map[string]string{"b": "a", "d/e": "."},
+			want:        []string{"a", "d/c"},
+			wantSkipped: []string{"b", "d/e"},
+		},
+		{
+			name:        "unreadable directory",
+			files:       []string{"a", "b/c", "d"},
+			unreadable:  []string{"b"},
+			want:        []string{"a", "d"},
+			wantSkipped: []string{"b/"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := setupTree(t, test.files, test.links, test.unreadable)
+
+			var names, skipped []string
+			descend := func(string) bool { return true }
+			skip := func(name string, _ error) { skipped = append(skipped, name) }
+			err := walkFiles(dir, "", descend, skip, func(name string, _ fs.FileInfo) error {
+				names = append(names, name)
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(names, test.want) {
+				t.Errorf("walked %v, want %v", names, test.want)
+			}
+			if !reflect.DeepEqual(skipped, test.wantSkipped) {
+				t.Errorf("skipped %v, want %v", skipped, test.wantSkipped)
+			}
+		})
+	}
+}
+
+func TestGenerateSkippedFiles(t *testing.T) {
+	tests := []struct {
+		name       string
+		links      map[string]string
+		unreadable []string
+		ignore     bool
+		want       bool
+	}{
+		{name: "nothing skipped", want: true},
+		{name: "symbolic link", links: map[string]string{"link": "a.txt"}, want: false},
+		{name: "symbolic link ignored", links: map[string]string{"link": "a.txt"}, ignore: true, want: true},
+		{name: "unreadable directory", unreadable: []string{"b"}, want: false},
+		{name: "unreadable directory ignored", unreadable: []string{"b"}, ignore: true, want: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := setupTree(t, []string{"a.txt", "b/c.txt"}, test.links, test.unreadable)
+
+			c, err := NewGenerateConfig(TraversalConfig{Directory: dir, Algorithms: []string{"md5"}, WorkerCount: 2, IgnoreSkippedFiles: test.ignore}, nil, filepath.Join(t.TempDir(), "out.hashdeep"), false, false, "", nil, ModeNone, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := Generate(context.Background(), c); got != test.want {
+				t.Errorf("Generate() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+// Creates a directory with the given files, symbolic links and unreadable
+// directories, skipping the test if the latter can be read anyway, e.g. by root
+func setupTree(t *testing.T, files []string, links map[string]string, unreadable []string) string {
+	t.Helper()
+
+	dir := t.TempDir()
+	for _, name := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, target := range links {
+		if err := os.Symlink(target, filepath.Join(dir, filepath.FromSlash(name))); err != nil {
+			t.Skipf("cannot create symbolic links: %v", err)
+		}
+	}
+	for _, name := range unreadable {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.Chmod(path, 0); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { _ = os.Chmod(path, 0755) })
+		if _, err := os.ReadDir(path); err == nil {
+			t.Skip("unreadable directories can be read by this user")
+		}
+	}
+
+	return dir
+}
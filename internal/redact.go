@@ -0,0 +1,134 @@
+/*
+Copyright © 2019 Even Holthe
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package internal
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const redacted = "***"
+
+// Flags whose values are credentials. Short flags are listed without their value separator.
+var secretFlags = []string{
+	"--account-key", "-k",
+	"--sas-token", "-s",
+	"--connection-string",
+	"--client-secret",
+	"--client-certificate-password",
+}
+
+var (
+	// SAS signatures in URLs and bare SAS tokens
+	sasSignature = regexp.MustCompile(`(?i)(^|[?&])(sig=)[^&;\s"']*`)
+	// Credentials embedded in connection strings
+	connectionStringSecret = regexp.MustCompile(`(?i)(AccountKey=|SharedAccessSignature=)[^;\s"']*`)
+
+	secretsMu sync.RWMutex
+	secrets   []string
+)
+
+// Registers credential values that must never be written anywhere, in any form.
+func registerSecrets(values ...string) {
+	secretsMu.Lock()
+	defer secretsMu.Unlock()
+
+	for _, value := range values {
+		if value == "" {
+			continue
+		}
+
+		secrets = append(secrets, value)
+		if escaped := url.QueryEscape(value); escaped != value {
+			secrets = append(secrets, escaped)
+		}
+	}
+}
+
+// Redact masks credentials in an arbitrary string, e.g. a log line or an error message.
+func Redact(s string) string {
+	secretsMu.RLock()
+	for _, secret := range secrets {
+		s = strings.ReplaceAll(s, secret, redacted)
+	}
+	secretsMu.RUnlock()
+
+	s = sasSignature.ReplaceAllString(s, "${1}${2}"+redacted)
+	s = connectionStringSecret.ReplaceAllString(s, "${1}"+redacted)
+
+	return s
+}
+
+// RedactArgs masks the values of credential flags in command line arguments.
+func RedactArgs(args []string) []string {
+	result := make([]string, len(args))
+	maskNext := false
+
+	for i, arg := range args {
+		switch {
+		case maskNext:
+			arg = redacted
+			maskNext = false
+		default:
+			for _, flag := range secretFlags {
+				long := strings.HasPrefix(flag, "--")
+				switch {
+				case arg == flag:
+					maskNext = true
+				case strings.HasPrefix(arg, flag+"="):
+					arg = flag + "=" + redacted
+				case !long && strings.HasPrefix(arg, flag) && !strings.HasPrefix(arg, "--"):
+					// Short flag with its value attached, e.g. -kSECRET
+					arg = flag + redacted
+				default:
+					continue
+				}
+				break
+			}
+		}
+
+		result[i] = Redact(arg)
+	}
+
+	return result
+}
+
+// RedactionHook masks credentials in every log entry before it is written.
+type RedactionHook struct{}
+
+func (h *RedactionHook) Levels() []log.Level {
+	return log.AllLevels
+}
+
+func (h *RedactionHook) Fire(entry *log.Entry) error {
+	entry.Message = Redact(entry.Message)
+
+	for key, value := range entry.Data {
+		switch v := value.(type) {
+		case string:
+			entry.Data[key] = Redact(v)
+		case error, fmt.Stringer:
+			entry.Data[key] = Redact(fmt.Sprint(v))
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,122 @@
+/*
+Copyright © 2019 Even Holthe
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package internal
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRedact(t *testing.T) {
+	registerSecrets("registered/secret+key==")
+
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{
+			name: "registered secret",
+			in:   "could not use registered/secret+key== for account",
+			want: "could not use *** for account",
+		},
+		{
+			name: "query escaped registered secret",
+			in:   "GET https://a.blob.core.windows.net/c?key=registered%2Fsecret%2Bkey%3D%3D",
+			want: "GET https://a.blob.core.windows.net/c?key=***",
+		},
+		{
+			name: "SAS signature in URL",
+			in:   "https://a.blob.core.windows.net/c/b?sv=2020-08-04&sig=abc%2Fdef&se=2030",
+			want: "https://a.blob.core.windows.net/c/b?sv=2020-08-04&sig=***&se=2030",
+		},
+		{
+			name: "bare SAS token",
+			in:   "sig=abcdef&sv=2020-08-04",
+			want: "sig=***&sv=2020-08-04",
+		},
+		{
+			name: "connection string",
+			in:   "AccountName=a;AccountKey=c2VjcmV0;SharedAccessSignature=sv=1&sig=x;EndpointSuffix=core.windows.net",
+			want: "AccountName=a;AccountKey=***;SharedAccessSignature=***;EndpointSuffix=core.windows.net",
+		},
+		{
+			name: "nothing to redact",
+			in:   "listed 100 blobs in container photos",
+			want: "listed 100 blobs in container photos",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := Redact(test.in); got != test.want {
+				t.Errorf("Redact(%q) = %q, want %q", test.in, got, test.want)
+			}
+		})
+	}
+}
+
+func TestRedactArgs(t *testing.T) {
+	tests := []struct {
+		name string
+		in   []string
+		want []string
+	}{
+		{
+			name: "separate value",
+			in:   []string{"generate", "--account-key", "secret", "-c", "photos"},
+			want: []string{"generate", "--account-key", "***", "-c", "photos"},
+		},
+		{
+			name: "long flag with equals",
+			in:   []string{"--sas-token=sv=1&sig=x", "--client-secret=secret"},
+			want: []string{"--sas-token=***", "--client-secret=***"},
+		},
+		{
+			name: "short flags",
+			in:   []string{"-k", "secret", "-ssecret", "-k=secret"},
+			want: []string{"-k", "***", "-s***", "-k=***"},
+		},
+		{
+			name: "connection string and certificate password",
+			in:   []string{"--connection-string", "AccountKey=secret", "--client-certificate-password=secret"},
+			want: []string{"--connection-string", "***", "--client-certificate-password=***"},
+		},
+		{
+			name: "similar flags are kept",
+			in:   []string{"--account-key-file", "/run/secrets/key", "--sas-token-file=/run/secrets/sas", "--account-name", "a"},
+			want: []string{"--account-key-file", "/run/secrets/key", "--sas-token-file=/run/secrets/sas", "--account-name", "a"},
+		},
+		{
+			name: "values after a separator are still redacted",
+			in:   []string{"--", "https://a.blob.core.windows.net/c?sig=secret"},
+			want: []string{"--", "https://a.blob.core.windows.net/c?sig=***"},
+		},
+		{
+			name: "trailing flag without value",
+			in:   []string{"generate", "--account-key"},
+			want: []string{"generate", "--account-key"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := RedactArgs(test.in); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("RedactArgs(%q) = %q, want %q", test.in, got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,143 @@
+/*
+Copyright © 2019 Even Holthe
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package internal
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/evenh/az-blob-hashdeep/internal/hashdeep"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// Number of entries sorted in memory before spilling to disk, as for compare
+const outputSortChunkSize = 500000
+
+// Sorts the entries of a complete output file by path, keeping its header.
+// Lines of blobs that were not hashed are sorted along with the entries, on
+// disk if needed. Fails if two entries have the same path, which happens when
+// sources write blobs of the same name to the same path.
+func sortOutputFile(path string, algorithms []string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	head, err := readOutputHeader(in)
+	if err != nil {
+		return errors.Wrapf(err, "could not read '%s'", path)
+	}
+	if _, err := in.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	reader := hashdeep.NewReader(in)
+	reader.Statuses = true
+	sorter := newExternalSorter(byPath, outputSortChunkSize, "")
+	defer sorter.Close()
+
+	for {
+		entry, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return errors.Wrapf(err, "could not parse '%s'", path)
+		}
+		if err := sorter.Add(entry); err != nil {
+			return err
+		}
+	}
+
+	entries, err := sorter.Sort()
+	if err != nil {
+		return err
+	}
+
+	out, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".sort-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(out.Name())
+	defer out.Close()
+	if info, err := in.Stat(); err == nil {
+		_ = out.Chmod(info.Mode())
+	}
+
+	w := bufio.NewWriterSize(out, 64*1024)
+	if _, err := w.WriteString(head); err != nil {
+		return err
+	}
+
+	var previous *hashdeep.Entry
+	for {
+		entry, err := entries.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		if previous != nil && entry.Path == previous.Path {
+			return errors.Errorf("'%s' appears more than once in '%s', map the sources to distinct paths", entry.Path, path)
+		}
+		previous = entry
+
+		line := hashdeep.FormatStatus(entry.Status, entry.Path) + "\n"
+		if entry.Status == "" {
+			line = formatEntry(entry.Size, entry.Hashes, algorithms, entry.Path)
+		}
+		if _, err := w.WriteString(line); err != nil {
+			return err
+		}
+	}
+
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+
+	log.Infof("sorted %s by path", path)
+	return os.Rename(out.Name(), path)
+}
+
+// Returns the header of an output file, which ends with the empty comment after the invocation
+func readOutputHeader(r io.Reader) (string, error) {
+	reader := bufio.NewReader(r)
+	var head strings.Builder
+
+	for {
+		line, err := reader.ReadString('\n')
+		head.WriteString(line)
+		if line == "##\n" {
+			return head.String(), nil
+		}
+		if err == io.EOF {
+			return "", errors.New("incomplete header")
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+}
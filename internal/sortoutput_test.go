@@ -0,0 +1,83 @@
+/*
+Copyright © 2019 Even Holthe
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSortOutputFile(t *testing.T) {
+	const header = "%%%% HASHDEEP-1.0\n%%%% size,md5,filename\n## Invoked from: test\n## $ az-blob-hashdeep generate\n##\n"
+
+	tests := []struct {
+		name    string
+		entries string
+		want    string
+		wantErr string
+	}{
+		{
+			name:    "entries and statuses",
+			entries: "1,aa,b/2\n## archived: b/1\n2,bb,a/1\n## rehydrating: c\n3,cc,\"\\\"q\\\"\"\n",
+			want:    "3,cc,\"\\\"q\\\"\"\n2,bb,a/1\n## archived: b/1\n1,aa,b/2\n## rehydrating: c\n",
+		},
+		{
+			name:    "paths with commas",
+			entries: "1,aa,b,c\n2,bb,a,b\n",
+			want:    "2,bb,a,b\n1,aa,b,c\n",
+		},
+		{
+			name:    "duplicate entries",
+			entries: "1,aa,a\n2,bb,b\n3,cc,a\n",
+			wantErr: "'a' appears more than once",
+		},
+		{
+			name:    "entry and status of the same path",
+			entries: "## archived: a\n1,aa,a\n",
+			wantErr: "'a' appears more than once",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "output.hashdeep")
+			if err := os.WriteFile(path, []byte(header+test.entries), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			err := sortOutputFile(path, []string{"md5"})
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("sortOutputFile() error = %v, want %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != header+test.want {
+				t.Errorf("sorted to\n%s\nwant\n%s", got, header+test.want)
+			}
+		})
+	}
+}
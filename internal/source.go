@@ -0,0 +1,224 @@
+/*
+Copyright © 2019 Even Holthe
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package internal
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob"
+	"github.com/evenh/az-blob-hashdeep/internal/hashes"
+	log "github.com/sirupsen/logrus"
+)
+
+// A container, or part of one, or a local directory listed into the output.
+// Several sources can be combined into one output, in which case their keys
+// keep the blobs apart.
+type source struct {
+	config *TraversalConfig
+	// Prepended to blob names in the checkpoint and state file, empty for a
+	// single source. Sources are listed in the order of their keys.
+	key string
+	// Prepended to output paths, e.g. the container name in a combined manifest
+	pathPrefix string
+
+	container   azblob.ContainerClient
+	hasher      hashes.Hasher
+	downloader  *hashes.DownloadAndCalculateHasher
+	incremental *incrementalHasher
+	pending     *rehydrationQueue
+	// Files and directories of a local directory that could not be listed
+	skipped uint64
+}
+
+// Identifies a blob in the checkpoint and state file
+func (s *source) id(item azblob.BlobItemInternal) string {
+	return s.key + hashes.BlobID(item)
+}
+
+// Returns the path of a blob in the output
+func (s *source) path(item azblob.BlobItemInternal) string {
+	return normalizePath(s.pathPrefix + s.config.relativePath(hashes.BlobID(item)))
+}
+
+// Lists the blobs or files of the source below prefix, starting at marker, and queues those matching the filter for hashing
+func (s *source) list(ctx context.Context, prefix string, marker string, progress *checkpoint, hashJobs chan<- hashJob) error {
+	if s.config.Directory != "" {
+		return listFiles(ctx, s, prefix, marker, progress, hashJobs)
+	}
+
+	return listBlobs(ctx, s, prefix, marker, progress, hashJobs)
+}
+
+func (s *source) newEntry(item azblob.BlobItemInternal) *HashdeepEntry {
+	entry := &HashdeepEntry{
+		size:    *item.Properties.ContentLength,
+		path:    s.path(item),
+		name:    s.id(item),
+		deleted: hashes.IsDeleted(item),
+	}
+	if item.Properties.Etag != nil {
+		entry.etag = *item.Properties.Etag
+	}
+	if item.Properties.LastModified != nil {
+		entry.lastModified = *item.Properties.LastModified
+	}
+
+	return entry
+}
+
+// Connects to the container, unless the source is a local directory, and configures the hashing strategy
+func (s *source) connect(ctx context.Context, caches hashCaches, previous map[string]*blobState) {
+	logger := log.WithField("phase", "storage_account_container_traversal")
+	c := s.config
+	if c.Directory == "" {
+		s.container = azureCheck(ctx, c)
+	}
+
+	if c.Directory != "" {
+		logger.Infof("hashing strategy: Read files from %s and calculate hashes locally (%s)", c.Directory, strings.Join(c.Algorithms, ","))
+		s.hasher = &hashes.FileHasher{Root: c.Directory, Algorithms: c.Algorithms}
+	} else if c.Calculate {
+		logger.Infof("hashing strategy: Download files and calculate hashes locally (%s)", strings.Join(c.Algorithms, ","))
+		s.downloader = &hashes.DownloadAndCalculateHasher{
+			Client:            &s.container,
+			Algorithms:        c.Algorithms,
+			Endpoint:          c.serviceURL(),
+			Account:           c.AccountName,
+			Container:         c.Container,
+			Archive:           c.Archive,
+			RehydrateTier:     azblob.AccessTier(c.RehydrateTier),
+			RehydratePriority: azblob.RehydratePriority(c.RehydratePriority),
+		}
+		if c.RehydrateWait > 0 {
+			s.pending = &rehydrationQueue{}
+		}
+		if c.CacheFile != "" {
+			s.downloader.Cache = caches.open(c.CacheFile)
+		}
+		s.hasher = s.downloader
+		// hasher = &hashes.BuiltinDownloadAndCalculateHasher{
+		// 	Client: &container,
+		// }
+	} else {
+		logger.Info("hashing strategy: Use hash from blob metadata")
+		s.hasher = &hashes.MetadataHasher{}
+	}
+
+	if previous != nil {
+		logger.Info("reusing digests of blobs unchanged since the previous manifest")
+		s.incremental = &incrementalHasher{previous: previous, key: s.key, algorithms: c.Algorithms, next: s.hasher}
+		s.hasher = s.incremental
+	}
+}
+
+// Hash caches by file, shared by the sources using them
+type hashCaches map[string]*hashes.Cache
+
+func (h hashCaches) open(path string) *hashes.Cache {
+	if cache, ok := h[path]; ok {
+		return cache
+	}
+
+	cache, err := hashes.OpenCache(path)
+	if err != nil {
+		log.Fatalf("error while opening hash cache: %v", err)
+	}
+	h[path] = cache
+
+	return cache
+}
+
+func (h hashCaches) close(logger *log.Entry) {
+	for _, cache := range h {
+		closeCache(cache, logger)
+	}
+}
+
+// ParseSource returns a copy of the shared settings for a source given as
+// account/container[/prefix][=path]. Without a path, the output paths are the
+// blob names. With one, the prefix is replaced by the path.
+func ParseSource(shared TraversalConfig, spec string) (TraversalConfig, error) {
+	location, mapping, mapped := strings.Cut(spec, "=")
+
+	parts := strings.SplitN(location, "/", 3)
+	if len(parts) < 2 || parts[0] == "" || parts[1] == "" {
+		return TraversalConfig{}, fmt.Errorf("invalid source '%s', expected account/container[/prefix][=path]", spec)
+	}
+
+	c := shared
+	c.AccountName, c.Container = parts[0], parts[1]
+	c.IncludePrefixes, c.StripPrefix, c.Prefix = nil, false, ""
+	if len(parts) == 3 && parts[2] != "" {
+		c.IncludePrefixes = []string{parts[2]}
+		c.StripPrefix = mapped
+	}
+	if mapped {
+		c.Prefix = mapping
+	}
+
+	return c, nil
+}
+
+// Describes the source in messages
+func (c *TraversalConfig) sourceName() string {
+	name := c.AccountName + "/" + c.Container
+	if len(c.IncludePrefixes) > 0 {
+		name += "/{" + strings.Join(c.IncludePrefixes, ",") + "}"
+	}
+
+	return name
+}
+
+// Reports whether any prefix of a contains one of b or vice versa
+func overlaps(a []string, b []string) bool {
+	for _, x := range a {
+		for _, y := range b {
+			if strings.HasPrefix(x, y) || strings.HasPrefix(y, x) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// Writes the output for several sources, keyed by account and container. The
+// output is sorted by path once complete, so it does not depend on the order
+// in which the blobs were hashed.
+func generateSources(ctx context.Context, c *GenerateConfig) bool {
+	sources := make([]*source, 0, len(c.Sources))
+	for i := range c.Sources {
+		config := &c.Sources[i]
+		sources = append(sources, &source{
+			config:     config,
+			key:        config.AccountName + "/" + config.Container + "/",
+			pathPrefix: config.Prefix,
+		})
+	}
+
+	// Sources of the same container do not overlap, so their prefixes order them
+	sort.Slice(sources, func(i, j int) bool {
+		if sources[i].key != sources[j].key {
+			return sources[i].key < sources[j].key
+		}
+		return sources[i].config.listingPrefixes()[0] < sources[j].config.listingPrefixes()[0]
+	})
+
+	return generate(ctx, c, sources, true, fmt.Sprintf("%d sources", len(sources)))
+}
@@ -0,0 +1,170 @@
+/*
+Copyright © 2019 Even Holthe
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package internal
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob"
+	"github.com/evenh/az-blob-hashdeep/internal/hashes"
+	"github.com/pkg/errors"
+)
+
+// Stored next to the output file when state is written
+const stateSuffix = ".state"
+
+// blobState is a line of a state file. It holds what is needed to tell
+// whether a blob has changed since the manifest was generated.
+type blobState struct {
+	Name         string            `json:"name"`
+	Etag         string            `json:"etag,omitempty"`
+	LastModified time.Time         `json:"last_modified"`
+	Size         int64             `json:"size"`
+	Digests      map[string]string `json:"digests"`
+}
+
+func newBlobState(e *HashdeepEntry) *blobState {
+	return &blobState{
+		Name:         e.name,
+		Etag:         e.etag,
+		LastModified: e.lastModified,
+		Size:         e.size,
+		Digests:      e.hashes,
+	}
+}
+
+// Reports whether the blob is the same as when its state was recorded. The
+// ETag changes upon every write, the modification time is only used for
+// state recorded without one.
+func (s *blobState) unchanged(item azblob.BlobItemInternal) bool {
+	if item.Properties.ContentLength == nil || *item.Properties.ContentLength != s.Size {
+		return false
+	}
+
+	if s.Etag != "" {
+		return item.Properties.Etag != nil && *item.Properties.Etag == s.Etag
+	}
+
+	return item.Properties.LastModified != nil && item.Properties.LastModified.Equal(s.LastModified)
+}
+
+// Reports whether digests for every algorithm were recorded
+func (s *blobState) hasAll(algorithms []string) bool {
+	for _, algorithm := range algorithms {
+		if s.Digests[algorithm] == "" {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Reads the state file of a previous manifest into a map keyed by blob name, see hashes.BlobID
+func loadState(manifest string) (map[string]*blobState, error) {
+	path := manifest + stateSuffix
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not open state of previous manifest")
+	}
+	defer file.Close()
+
+	state := make(map[string]*blobState)
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	line := 0
+
+	for scanner.Scan() {
+		line++
+		s := &blobState{}
+		if err := json.Unmarshal(scanner.Bytes(), s); err != nil {
+			return nil, errors.Wrapf(err, "could not parse '%s' (line %d)", path, line)
+		}
+		state[s.Name] = s
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrapf(err, "could not read '%s'", path)
+	}
+
+	return state, nil
+}
+
+// Reuses the digests of unchanged blobs from a previous run, hashing the rest with the next hasher
+type incrementalHasher struct {
+	previous map[string]*blobState
+	// Key of the source, see source.id
+	key        string
+	algorithms []string
+	next       hashes.Hasher
+	reused     uint64
+}
+
+func (h *incrementalHasher) Hash(ctx context.Context, item azblob.BlobItemInternal) (*hashes.Digests, error) {
+	if s, ok := h.previous[h.key+hashes.BlobID(item)]; ok && s.unchanged(item) && s.hasAll(h.algorithms) {
+		atomic.AddUint64(&h.reused, 1)
+
+		values := make(map[string]string, len(h.algorithms))
+		for _, algorithm := range h.algorithms {
+			values[algorithm] = s.Digests[algorithm]
+		}
+
+		return &hashes.Digests{Values: values, BytesRead: hashes.NotRead}, nil
+	}
+
+	return h.next.Hash(ctx, item)
+}
+
+// Writes the state file next to an output file
+type stateWriter struct {
+	*appendFile
+}
+
+func newStateWriter(path string) (*stateWriter, error) {
+	file, err := createAppendFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not create state file '%s'", path)
+	}
+
+	return &stateWriter{file}, nil
+}
+
+// Opens the state file of an interrupted run, discarding anything after offset
+func reopenStateWriter(path string, offset int64) (*stateWriter, error) {
+	file, err := reopenAppendFile(path, offset)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not open state file '%s'", path)
+	}
+
+	return &stateWriter{file}, nil
+}
+
+func (w *stateWriter) write(s *blobState) error {
+	line, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+
+	if err := w.appendFile.write(string(line) + "\n"); err != nil {
+		return errors.Wrapf(err, "could not write state file '%s'", w.path)
+	}
+
+	return nil
+}
@@ -45,3 +45,13 @@ func customHttpClient(maxConnections int, idleConnectionTimeout time.Duration) *
 		Transport: t,
 	}
 }
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,193 @@
+/*
+Copyright © 2019 Even Holthe
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package internal
+
+import (
+	"context"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/evenh/az-blob-hashdeep/internal/hashdeep"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+type verifyResult struct {
+	matched    uint64
+	mismatched uint64
+	missing    uint64
+	extra      uint64
+	// Present in the container, but could not be hashed, e.g. archived blobs
+	skipped uint64
+}
+
+func (r *verifyResult) failed() bool {
+	return r.mismatched > 0 || r.missing > 0 || r.extra > 0 || r.skipped > 0
+}
+
+func Verify(ctx context.Context, c *VerifyConfig) {
+	logger := log.WithField("phase", "verify")
+
+	expected, err := loadHashdeepFile(c.InputFile, c.Algorithms)
+	if err != nil {
+		log.Fatalf("error while reading hashdeep file: %v", err)
+	}
+	logger.Infof("loaded %d entries from %s", len(expected), c.InputFile)
+
+	var wg sync.WaitGroup
+	result := &verifyResult{}
+	files := make(chan *HashdeepEntry, channelSize)
+
+	configureVerifier(ctx, files, expected, c.Prefix, result, &wg)
+	listed := traverseBlobStorage(ctx, files, &c.TraversalConfig, traversalOptions{})
+
+	log.Debugf("awaiting wg")
+	wg.Wait()
+
+	if ctx.Err() != nil {
+		logger.Error("verification was cancelled before completion")
+		os.Exit(1)
+	}
+	if !listed {
+		logger.Error("verification failed, the container could not be listed completely")
+		os.Exit(1)
+	}
+
+	// Whatever is left in the expected set was never seen in the container
+	missing := make([]string, 0, len(expected))
+	for path := range expected {
+		missing = append(missing, path)
+	}
+	sort.Strings(missing)
+	for _, path := range missing {
+		logger.WithField("status", "missing").Warnf("%s: not found in container", path)
+		result.missing++
+	}
+
+	logger.Infof("matched: %d, mismatched: %d, missing: %d, extra: %d, not hashed: %d", result.matched, result.mismatched, result.missing, result.extra, result.skipped)
+
+	if result.failed() {
+		logger.Error("verification failed")
+		os.Exit(1)
+	}
+
+	logger.Info("verification passed")
+	os.Exit(0)
+}
+
+// Reads a hashdeep file into a map keyed by file path
+func loadHashdeepFile(path string, algorithms []string) (map[string]*hashdeep.Entry, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	reader := hashdeep.NewReader(file)
+	entries := make(map[string]*hashdeep.Entry)
+
+	for {
+		entry, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "could not parse '%s'", path)
+		}
+
+		if !hasAnyHash(entry, algorithms) {
+			return nil, errors.Errorf("'%s' contains none of the hashes %s (line %d)", path, strings.Join(algorithms, ","), reader.Line())
+		}
+
+		// Paths written by other tools may not be normalized
+		entry.Path = normalizePath(entry.Path)
+		if _, exists := entries[entry.Path]; exists {
+			log.Warnf("duplicate entry for '%s' in '%s', using the last one", entry.Path, path)
+		}
+		entries[entry.Path] = entry
+	}
+
+	return entries, nil
+}
+
+func configureVerifier(ctx context.Context, files chan *HashdeepEntry, expected map[string]*hashdeep.Entry, prefix string, result *verifyResult, wg *sync.WaitGroup) {
+	logger := log.WithField("phase", "results_verifier")
+
+	wg.Add(1)
+
+	go func() {
+		defer wg.Done()
+
+		progressTicker := time.NewTicker(progressInterval)
+		defer progressTicker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				log.Warnf("will not verify more entries because of cancellation")
+				return
+			case <-progressTicker.C:
+				logger.Infof("verified so far: %d", result.matched+result.mismatched+result.extra)
+			case actual, more := <-files:
+				if !more {
+					return
+				}
+
+				path := normalizePath(prefix + actual.path)
+				want, found := expected[path]
+				if !found {
+					logger.WithField("status", "extra").Warnf("%s: not present in hashdeep file", path)
+					result.extra++
+					continue
+				}
+				delete(expected, path)
+
+				switch {
+				case actual.status != "":
+					logger.WithField("status", actual.status).Warnf("%s: could not be hashed", path)
+					result.skipped++
+				case want.Size != actual.size:
+					logger.WithField("status", "mismatch").Warnf("%s: expected size %d, got %d", path, want.Size, actual.size)
+					result.mismatched++
+				case !sameHashes(want, &hashdeep.Entry{Hashes: actual.hashes}):
+					for algorithm, value := range actual.hashes {
+						if wanted, ok := want.Hashes[algorithm]; ok && !strings.EqualFold(wanted, value) {
+							logger.WithField("status", "mismatch").Warnf("%s: expected %s %s, got %s", path, algorithm, wanted, value)
+						}
+					}
+					result.mismatched++
+				default:
+					logger.WithField("status", "match").Debugf("%s: ok", path)
+					result.matched++
+				}
+			}
+		}
+	}()
+}
+
+func hasAnyHash(entry *hashdeep.Entry, algorithms []string) bool {
+	for _, algorithm := range algorithms {
+		if _, ok := entry.Hashes[algorithm]; ok {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,324 @@
+/*
+Copyright © 2019 Even Holthe
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package internal
+
+import (
+	"context"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/evenh/az-blob-hashdeep/internal/hashdeep"
+	"github.com/evenh/az-blob-hashdeep/internal/hashes"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// VerifyLocal compares a container with a local directory without writing
+// either to a file. Both are listed concurrently in name order and merged, so
+// missing files and size differences are reported as soon as they are listed.
+// Files of the same size on both sides are hashed by the shared workers and
+// their digests compared once both are done.
+//
+// The merge relies on both sides being listed in path order. Names are listed
+// in byte order, which is only the order of the normalized paths, see
+// normalizePath, if the names are normalized already. Verification therefore
+// stops at the first name that is not in Unicode NFC, such names can be
+// compared with generate and compare instead.
+func VerifyLocal(ctx context.Context, c *VerifyLocalConfig) {
+	logger := log.WithField("phase", "verify_local")
+
+	container := &source{config: &c.TraversalConfig, key: "container/"}
+	local := &source{config: &c.local, key: "local/"}
+
+	caches := hashCaches{}
+	defer caches.close(logger)
+	container.connect(ctx, caches, nil)
+	local.connect(ctx, caches, nil)
+
+	var wg sync.WaitGroup
+	result := &verifyResult{}
+	files := make(chan *HashdeepEntry, channelSize)
+
+	pairs := &hashPairs{pairs: make(map[string]*hashPair)}
+	configureLocalComparer(ctx, files, local, pairs, result, &wg)
+	hashJobs, workersGroup := configureBackgroundWorkers(ctx, c.WorkerCount, files)
+
+	logger.Infof("comparing container '%s' with %s", c.Container, c.LocalDirectory)
+	listCtx, stopListing := context.WithCancel(ctx)
+	listed := mergeListings(ctx, openListing(listCtx, container), openListing(listCtx, local), hashJobs, pairs, result)
+	stopListing()
+	close(hashJobs)
+
+	logger.Debug("awaiting workersGroup")
+	workersGroup.Wait()
+	if container.pending != nil && len(container.pending.items) > 0 {
+		awaitRehydration(ctx, container, c.WorkerCount, files)
+	}
+	close(files)
+
+	log.Debugf("awaiting wg")
+	wg.Wait()
+
+	if ctx.Err() != nil {
+		logger.Error("verification was cancelled before completion")
+		os.Exit(1)
+	}
+
+	// Anything skipped in the directory cannot be compared
+	result.skipped += local.skipped
+
+	// A safeguard, the workers report every queued blob and file
+	for _, path := range pairs.remaining() {
+		logger.WithField("status", "failed").Warnf("%s: could not be hashed", path)
+		result.skipped++
+	}
+
+	logger.Infof("matched: %d, mismatched: %d, missing locally: %d, not in container: %d, not hashed: %d", result.matched, result.mismatched, result.missing, result.extra, result.skipped)
+
+	if !listed {
+		logger.Error("verification is incomplete, listing failed")
+		os.Exit(1)
+	}
+
+	if result.failed() {
+		logger.Error("verification failed")
+		os.Exit(1)
+	}
+
+	logger.Info("verification passed")
+	os.Exit(0)
+}
+
+// An ordered listing of a source, read one blob or file at a time
+type listing struct {
+	source *source
+	items  chan hashJob
+	err    chan error
+
+	current hashJob
+	path    string
+	done    bool
+}
+
+// Lists every prefix of the source in the background
+func openListing(ctx context.Context, s *source) *listing {
+	l := &listing{source: s, items: make(chan hashJob, maxAzResults), err: make(chan error, 1)}
+
+	go func() {
+		var err error
+		for _, prefix := range s.config.listingPrefixes() {
+			if err = s.list(ctx, prefix, "", nil, l.items); err != nil {
+				break
+			}
+		}
+		l.err <- err
+		close(l.items)
+	}()
+
+	return l
+}
+
+// Moves to the next item, returning the error of the listing once it is
+// exhausted, or an error if the item would break the path order of the merge
+func (l *listing) next() error {
+	job, more := <-l.items
+	if !more {
+		l.done = true
+		return <-l.err
+	}
+
+	previous := l.path
+	l.current, l.path = job, l.source.path(job.item)
+
+	if name := l.source.pathPrefix + l.source.config.relativePath(hashes.BlobID(job.item)); name != l.path {
+		return errors.Errorf("'%s' is not in Unicode NFC and cannot be verified in order, use generate and compare instead", name)
+	}
+	if previous != "" && l.path <= previous {
+		return errors.Errorf("'%s' was listed after '%s' and cannot be verified in order", l.path, previous)
+	}
+
+	return nil
+}
+
+// Merges the listings of the container and the local directory, reporting
+// paths present on one side only and differing sizes, and queueing the rest
+// for hashing. Reports whether both listings completed.
+func mergeListings(ctx context.Context, container *listing, local *listing, hashJobs chan<- hashJob, pairs *hashPairs, result *verifyResult) bool {
+	logger := log.WithField("phase", "verify_local")
+
+	for _, l := range []*listing{container, local} {
+		if err := l.next(); err != nil {
+			handleErrors("list", err)(logger)
+			return false
+		}
+	}
+
+	queue := func(job hashJob) bool {
+		select {
+		case hashJobs <- job:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+
+	for !container.done || !local.done {
+		var advance []*listing
+
+		switch {
+		case local.done || (!container.done && container.path < local.path):
+			logger.WithField("status", "missing").Warnf("%s: not found in local directory", container.path)
+			atomic.AddUint64(&result.missing, 1)
+			advance = []*listing{container}
+		case container.done || local.path < container.path:
+			logger.WithField("status", "extra").Warnf("%s: not found in container", local.path)
+			atomic.AddUint64(&result.extra, 1)
+			advance = []*listing{local}
+		default:
+			expected, actual := *container.current.item.Properties.ContentLength, *local.current.item.Properties.ContentLength
+			if expected != actual {
+				logger.WithField("status", "mismatch").Warnf("%s: size %d in container, %d locally", container.path, expected, actual)
+				atomic.AddUint64(&result.mismatched, 1)
+			} else {
+				pairs.add(container.path)
+				if !queue(container.current) || !queue(local.current) {
+					return false
+				}
+			}
+			advance = []*listing{container, local}
+		}
+
+		for _, l := range advance {
+			if err := l.next(); err != nil {
+				handleErrors("list", err)(logger)
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// Paths queued for hashing on both sides, until both sides are hashed
+type hashPairs struct {
+	mu    sync.Mutex
+	pairs map[string]*hashPair
+}
+
+type hashPair struct {
+	blob *HashdeepEntry
+	file *HashdeepEntry
+}
+
+func (p *hashPairs) add(path string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.pairs[path] = &hashPair{}
+}
+
+// Records a hashed side of a path, returning the pair once both sides are hashed
+func (p *hashPairs) hashed(path string, entry *HashdeepEntry, local bool) *hashPair {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	pair, ok := p.pairs[path]
+	if !ok {
+		return nil
+	}
+	if local {
+		pair.file = entry
+	} else {
+		pair.blob = entry
+	}
+	if pair.blob == nil || pair.file == nil {
+		return nil
+	}
+	delete(p.pairs, path)
+
+	return pair
+}
+
+// Returns the paths of which a side was never hashed, in name order
+func (p *hashPairs) remaining() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	paths := make([]string, 0, len(p.pairs))
+	for path := range p.pairs {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	return paths
+}
+
+// Compares the digests of every path once both of its sides are hashed
+func configureLocalComparer(ctx context.Context, files chan *HashdeepEntry, local *source, pairs *hashPairs, result *verifyResult, wg *sync.WaitGroup) {
+	logger := log.WithField("phase", "results_verifier")
+
+	wg.Add(1)
+
+	go func() {
+		defer wg.Done()
+
+		progressTicker := time.NewTicker(progressInterval)
+		defer progressTicker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				log.Warnf("will not verify more entries because of cancellation")
+				return
+			case <-progressTicker.C:
+				logger.Infof("verified so far: %d", atomic.LoadUint64(&result.matched)+atomic.LoadUint64(&result.mismatched))
+			case entry, more := <-files:
+				if !more {
+					return
+				}
+
+				if pair := pairs.hashed(entry.path, entry, strings.HasPrefix(entry.name, local.key)); pair != nil {
+					compareLocal(logger, entry.path, pair.blob, pair.file, result)
+				}
+			}
+		}
+	}()
+}
+
+func compareLocal(logger *log.Entry, path string, blob *HashdeepEntry, file *HashdeepEntry, result *verifyResult) {
+	switch {
+	case blob.status != "":
+		logger.WithField("status", blob.status).Warnf("%s: could not be hashed in container", path)
+		atomic.AddUint64(&result.skipped, 1)
+	case file.status != "":
+		logger.WithField("status", file.status).Warnf("%s: could not be hashed locally", path)
+		atomic.AddUint64(&result.skipped, 1)
+	case !sameHashes(&hashdeep.Entry{Hashes: blob.hashes}, &hashdeep.Entry{Hashes: file.hashes}):
+		for algorithm, value := range blob.hashes {
+			if actual := file.hashes[algorithm]; !strings.EqualFold(actual, value) {
+				logger.WithField("status", "mismatch").Warnf("%s: %s %s in container, %s locally", path, algorithm, value, actual)
+			}
+		}
+		atomic.AddUint64(&result.mismatched, 1)
+	default:
+		logger.WithField("status", "match").Debugf("%s: ok", path)
+		atomic.AddUint64(&result.matched, 1)
+	}
+}
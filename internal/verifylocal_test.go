@@ -0,0 +1,172 @@
+/*
+Copyright © 2019 Even Holthe
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package internal
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob"
+)
+
+// A listed blob or file and its size
+type listedItem struct {
+	name string
+	size int64
+}
+
+// Returns a listing of the items, in the given order, ending with err
+func fakeListing(key string, items []listedItem, err error) *listing {
+	s := &source{config: &TraversalConfig{}, key: key}
+	l := &listing{source: s, items: make(chan hashJob, len(items)), err: make(chan error, 1)}
+
+	for _, item := range items {
+		name, size := item.name, item.size
+		l.items <- hashJob{item: azblob.BlobItemInternal{Name: &name, Properties: &azblob.BlobPropertiesInternal{ContentLength: &size}}, source: s}
+	}
+	close(l.items)
+	l.err <- err
+
+	return l
+}
+
+func TestMergeListings(t *testing.T) {
+	tests := []struct {
+		name           string
+		container      []listedItem
+		local          []listedItem
+		listErr        error
+		want           bool
+		wantHashed     []string
+		wantMissing    uint64
+		wantExtra      uint64
+		wantMismatched uint64
+	}{
+		{
+			name:       "same paths",
+			container:  []listedItem{{"a", 1}, {"b", 2}},
+			local:      []listedItem{{"a", 1}, {"b", 2}},
+			want:       true,
+			wantHashed: []string{"a", "b"},
+		},
+		{
+			// '-' sorts before '/', so a-c is listed before the files in directory a
+			name:       "directory order",
+			container:  []listedItem{{"a-c", 1}, {"a/b", 1}, {"a0", 1}},
+			local:      []listedItem{{"a-c", 1}, {"a/b", 1}, {"a0", 1}},
+			want:       true,
+			wantHashed: []string{"a-c", "a/b", "a0"},
+		},
+		{
+			name:        "one-sided paths",
+			container:   []listedItem{{"a", 1}, {"c", 1}, {"e", 1}},
+			local:       []listedItem{{"b", 1}, {"c", 1}, {"d", 1}},
+			want:        true,
+			wantHashed:  []string{"c"},
+			wantMissing: 2,
+			wantExtra:   2,
+		},
+		{
+			name:        "empty directory",
+			container:   []listedItem{{"a", 1}, {"b", 1}},
+			want:        true,
+			wantMissing: 2,
+		},
+		{
+			name:      "empty container",
+			local:     []listedItem{{"a", 1}},
+			want:      true,
+			wantExtra: 1,
+		},
+		{
+			name:           "size mismatch",
+			container:      []listedItem{{"a", 1}, {"b", 2}},
+			local:          []listedItem{{"a", 1}, {"b", 3}},
+			want:           true,
+			wantHashed:     []string{"a"},
+			wantMismatched: 1,
+		},
+		{
+			name:       "name in NFC",
+			container:  []listedItem{{"a", 1}, {"caf\u00e9", 1}},
+			local:      []listedItem{{"a", 1}, {"caf\u00e9", 1}},
+			want:       true,
+			wantHashed: []string{"a", "caf\u00e9"},
+		},
+		{
+			name:       "name not in NFC",
+			container:  []listedItem{{"a", 1}, {"caf\u00e9", 1}},
+			local:      []listedItem{{"a", 1}, {"cafe\u0301", 1}},
+			want:       false,
+			wantHashed: []string{"a"},
+		},
+		{
+			name:       "out of order",
+			container:  []listedItem{{"a", 1}, {"c", 1}, {"b", 1}},
+			local:      []listedItem{{"a", 1}, {"b", 1}, {"c", 1}},
+			want:       false,
+			wantHashed: []string{"a", "c"},
+			wantExtra:  1,
+		},
+		{
+			name:       "duplicate path",
+			container:  []listedItem{{"a", 1}, {"a", 1}},
+			local:      []listedItem{{"a", 1}},
+			want:       false,
+			wantHashed: []string{"a"},
+		},
+		{
+			name:       "listing error",
+			container:  []listedItem{{"a", 1}},
+			local:      []listedItem{{"a", 1}},
+			listErr:    errors.New("connection reset"),
+			want:       false,
+			wantHashed: []string{"a"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			hashJobs := make(chan hashJob, 2*(len(test.container)+len(test.local)))
+			pairs := &hashPairs{pairs: make(map[string]*hashPair)}
+			result := &verifyResult{}
+
+			got := mergeListings(context.Background(), fakeListing("container/", test.container, test.listErr), fakeListing("local/", test.local, nil), hashJobs, pairs, result)
+			close(hashJobs)
+
+			if got != test.want {
+				t.Errorf("mergeListings() = %v, want %v", got, test.want)
+			}
+
+			// Both sides of a path are queued
+			hashed := []string{}
+			for job := range hashJobs {
+				if path := job.source.path(job.item); len(hashed) == 0 || hashed[len(hashed)-1] != path {
+					hashed = append(hashed, path)
+				}
+			}
+			if want := append([]string{}, test.wantHashed...); !reflect.DeepEqual(hashed, want) || !reflect.DeepEqual(pairs.remaining(), want) {
+				t.Errorf("hashed %v and paired %v, want %v", hashed, pairs.remaining(), test.wantHashed)
+			}
+
+			if result.missing != test.wantMissing || result.extra != test.wantExtra || result.mismatched != test.wantMismatched {
+				t.Errorf("missing %d, extra %d, mismatched %d, want %d, %d, %d", result.missing, result.extra, result.mismatched, test.wantMissing, test.wantExtra, test.wantMismatched)
+			}
+		})
+	}
+}
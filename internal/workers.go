@@ -22,15 +22,28 @@ import (
 
 	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob"
 	"github.com/evenh/az-blob-hashdeep/internal/hashes"
+	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 )
 
 var logger = log.WithField("phase", "background_worker")
 
-func configureBackgroundWorkers(ctx context.Context, count int, hasher hashes.Hasher, outputChannel chan *HashdeepEntry) (chan azblob.BlobItemInternal, *sync.WaitGroup) {
+// Status of blobs that could not be hashed because of an error. They are
+// reported like skipped blobs, but left out of manifests.
+const statusFailed = "failed"
+
+// A listed blob along with the source it belongs to
+type hashJob struct {
+	item   azblob.BlobItemInternal
+	source *source
+}
+
+// Spawns workers hashing the queued blobs with the hasher of their source.
+// Blobs being rehydrated are handed to the pending queue of their source if it has one.
+func configureBackgroundWorkers(ctx context.Context, count int, outputChannel chan *HashdeepEntry) (chan hashJob, *sync.WaitGroup) {
 	var (
 		wg       sync.WaitGroup
-		jobQueue = make(chan azblob.BlobItemInternal)
+		jobQueue = make(chan hashJob)
 	)
 
 	logger.Infof("spawning %d background workers", count)
@@ -44,24 +57,47 @@ func configureBackgroundWorkers(ctx context.Context, count int, hasher hashes.Ha
 			workerLog := logger.WithField("instance", fmt.Sprintf("worker-%d", workerNum))
 			workerLog.Debugf("worker alive")
 
-			for b := range jobQueue {
+			// The results writer stops reading upon cancellation
+			emit := func(entry *HashdeepEntry) {
+				select {
+				case outputChannel <- entry:
+				case <-ctx.Done():
+				}
+			}
+
+			for job := range jobQueue {
 				select {
 				case <-ctx.Done():
 					workerLog.Debug("shutting down worker by request")
 					return
 				default:
-					hash, err := hasher.Hash(ctx, b)
+					b, s := job.item, job.source
+					digests, err := s.hasher.Hash(ctx, b)
 
-					if hash == nil || err != nil {
-						handleErrors("hash_blob", fmt.Errorf("could not hash %s: %v", *b.Name, err))(workerLog)
-						return
+					var skipped *hashes.SkippedError
+					if errors.As(err, &skipped) {
+						if skipped.Status == hashes.StatusRehydrating && s.pending.add(b) {
+							continue
+						}
+
+						workerLog.WithField("status", skipped.Status).Infof("skipping %s", s.path(b))
+						entry := s.newEntry(b)
+						entry.status = skipped.Status
+						emit(entry)
+						continue
 					}
 
-					outputChannel <- &HashdeepEntry{
-						size:    *b.Properties.ContentLength,
-						md5hash: *hash,
-						path:    *b.Name,
+					if digests == nil || err != nil {
+						handleErrors("hash_blob", fmt.Errorf("could not hash %s: %v", s.path(b), err))(workerLog)
+						entry := s.newEntry(b)
+						entry.status = statusFailed
+						emit(entry)
+						continue
 					}
+
+					entry := s.newEntry(b)
+					entry.hashes = digests.Values
+					emit(entry)
 				}
 			}
 
@@ -20,6 +20,7 @@ import (
 	"strconv"
 
 	"github.com/evenh/az-blob-hashdeep/cmd"
+	"github.com/evenh/az-blob-hashdeep/internal"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -38,6 +39,9 @@ func main() {
 		DisableTimestamp: false,
 	})
 
+	// Never log credentials
+	log.AddHook(&internal.RedactionHook{})
+
 	log.SetLevel(log.InfoLevel)
 	if debugFlag, _ := strconv.ParseBool(os.Getenv("ABH_DEBUG")); debugFlag {
 		log.SetLevel(log.TraceLevel)